@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/alaa/pencil-go/config"
+	"github.com/alaa/pencil-go/consul"
+	"github.com/alaa/pencil-go/etcd"
+	"github.com/alaa/pencil-go/file"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/alaa/pencil-go/zookeeper"
+	"github.com/go-zookeeper/zk"
+	consulclient "github.com/hashicorp/consul/api"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultEtcdEndpoint    = "localhost:2379"
+	etcdDialTimeout        = 5 * time.Second
+	defaultZookeeperServer = "localhost:2181"
+)
+
+// serviceBackend is service repository selected by configuration
+type serviceBackend struct {
+	repository registry.ServiceRepository
+	backends   []backend
+	// closers release clients and leases of the backend when daemon is replaced or stopped
+	closers []io.Closer
+}
+
+// newServiceBackend fans out to all configured backends through composite repository when more than one is given
+func newServiceBackend(cfg *config.Config) (*serviceBackend, error) {
+	names := cfg.Backends()
+	if len(names) == 1 {
+		return newNamedBackend(cfg, names[0])
+	}
+	composite := &serviceBackend{}
+	compositeBackends := []registry.Backend{}
+	for _, name := range names {
+		serviceBackend, err := newNamedBackend(cfg, name)
+		if err != nil {
+			composite.close()
+			return nil, err
+		}
+		compositeBackends = append(compositeBackends, registry.Backend{Name: name, Repository: serviceBackend.repository})
+		composite.backends = append(composite.backends, serviceBackend.backends...)
+		composite.closers = append(composite.closers, serviceBackend.closers...)
+	}
+	composite.repository = registry.NewCompositeServiceRepository(compositeBackends...)
+	return composite, nil
+}
+
+func newNamedBackend(cfg *config.Config, name string) (*serviceBackend, error) {
+	switch name {
+	case config.EtcdBackend:
+		return newEtcdBackend(cfg)
+	case config.ZookeeperBackend:
+		return newZookeeperBackend(cfg)
+	case config.FileBackend:
+		return newFileBackend(cfg), nil
+	}
+	return newConsulBackend(cfg)
+}
+
+func (b *serviceBackend) close() {
+	for _, closer := range b.closers {
+		if err := closer.Close(); err != nil {
+			log.Printf("Error occured during closing service backend: %v\n", err)
+		}
+	}
+}
+
+func newConsulBackend(cfg *config.Config) (*serviceBackend, error) {
+	client, err := consulclient.NewClient(newConsulConfig(cfg.Consul))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create consul client: %v", err)
+	}
+	// agent self endpoint cannot be canceled, so services of the local agent are listed instead
+	probe := func(ctx context.Context) error {
+		_, err := client.Agent().ServicesWithFilterOpts("", (&consulclient.QueryOptions{}).WithContext(ctx))
+		return err
+	}
+	return &serviceBackend{
+		repository: consul.NewServiceRepository(client.Agent(), cfg.OwnerTag),
+		backends:   []backend{{"consul", probe}},
+	}, nil
+}
+
+func newEtcdBackend(cfg *config.Config) (*serviceBackend, error) {
+	endpoints := cfg.Etcd.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = []string{defaultEtcdEndpoint}
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		Username:    cfg.Etcd.Username,
+		Password:    cfg.Etcd.Password,
+		DialTimeout: etcdDialTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create etcd client: %v", err)
+	}
+	probe := func(ctx context.Context) error {
+		_, err := client.Get(ctx, cfg.Etcd.Prefix, clientv3.WithCountOnly())
+		return err
+	}
+	repository := etcd.NewServiceRepository(client, cfg.Etcd.Prefix, cfg.Hostname, time.Duration(cfg.Etcd.LeaseTTL))
+	return &serviceBackend{
+		repository: repository,
+		backends:   []backend{{"etcd", probe}},
+		closers:    []io.Closer{repository, client},
+	}, nil
+}
+
+func newZookeeperBackend(cfg *config.Config) (*serviceBackend, error) {
+	servers := cfg.Zookeeper.Servers
+	if len(servers) == 0 {
+		servers = []string{defaultZookeeperServer}
+	}
+	conn, events, err := zk.Connect(servers, time.Duration(cfg.Zookeeper.SessionTimeout), zk.WithLogInfo(false))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create zookeeper client: %v", err)
+	}
+	go logZookeeperSessions(events)
+	probe := func(ctx context.Context) error {
+		if conn.State() != zk.StateHasSession {
+			return fmt.Errorf("no zookeeper session, connection is %v", conn.State())
+		}
+		return nil
+	}
+	return &serviceBackend{
+		repository: zookeeper.NewServiceRepository(conn, cfg.Zookeeper.BasePath, cfg.Hostname),
+		backends:   []backend{{"zookeeper", probe}},
+		closers:    []io.Closer{closerFunc(conn.Close)},
+	}, nil
+}
+
+// newFileBackend keeps services in local file, it is reachable when its directory exists
+func newFileBackend(cfg *config.Config) *serviceBackend {
+	probe := func(ctx context.Context) error {
+		_, err := os.Stat(filepath.Dir(cfg.ServicesFile.Path))
+		return err
+	}
+	return &serviceBackend{
+		repository: file.NewServiceRepository(cfg.ServicesFile.Path, file.Format(cfg.ServicesFile.Format)),
+		backends:   []backend{{"file", probe}},
+	}
+}
+
+// logZookeeperSessions reports expired sessions, services registered with them are removed by zookeeper
+// and registered again by the next synchronization
+func logZookeeperSessions(events <-chan zk.Event) {
+	for event := range events {
+		if event.State == zk.StateExpired {
+			log.Println("Zookeeper session expired, services will be registered again")
+		}
+	}
+}
+
+// closerFunc adapts Close methods which cannot fail to io.Closer
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"github.com/alaa/pencil-go/config"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServiceBackendFansOutToAllConfiguredBackends(t *testing.T) {
+	cfg := config.Default()
+	cfg.Backend = "consul,file"
+	cfg.ServicesFile.Path = filepath.Join(os.TempDir(), "pencil-services.json")
+
+	serviceBackend, err := newServiceBackend(cfg)
+
+	assert.Nil(t, err)
+	composite, ok := serviceBackend.repository.(*registry.CompositeServiceRepository)
+	assert.True(t, ok)
+	assert.Len(t, composite.Backends(), 2)
+	assert.Equal(t, "consul", serviceBackend.backends[0].name)
+	assert.Equal(t, "file", serviceBackend.backends[1].name)
+	assert.Nil(t, serviceBackend.backends[1].probe(context.Background()))
+}
+
+func TestServiceBackendIsNotWrappedWhenSingleBackendIsConfigured(t *testing.T) {
+	cfg := config.Default()
+
+	serviceBackend, err := newServiceBackend(cfg)
+
+	assert.Nil(t, err)
+	_, composite := serviceBackend.repository.(*registry.CompositeServiceRepository)
+	assert.False(t, composite)
+	assert.Len(t, serviceBackend.backends, 1)
+}
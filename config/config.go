@@ -0,0 +1,448 @@
+// Package config loads pencil daemon settings.
+//
+// Settings are resolved in the following order, later sources overriding earlier ones:
+//
+//  1. built-in defaults
+//  2. configuration file given with -config flag or PENCIL_CONFIG variable,
+//     format is chosen by extension: .json, .yaml, .yml or .toml
+//  3. environment variables, named after flags with PENCIL_ prefix,
+//     e.g. PENCIL_SYNC_INTERVAL for -sync-interval
+//  4. command-line flags
+//
+// Empty docker endpoint and consul settings fall back to the environment
+// understood by the docker and consul clients (DOCKER_HOST, CONSUL_HTTP_ADDR, ...).
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/alaa/pencil-go/docker"
+	"github.com/alaa/pencil-go/file"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const envPrefix = "PENCIL_"
+
+// Service backends keeping registered services
+const (
+	ConsulBackend    = "consul"
+	EtcdBackend      = "etcd"
+	ZookeeperBackend = "zookeeper"
+	FileBackend      = "file"
+)
+
+// Config holds pencil daemon settings
+type Config struct {
+	File           string       `json:"-" yaml:"-" toml:"-"`
+	DryRun         bool         `json:"-" yaml:"-" toml:"-"`
+	Output         string       `json:"-" yaml:"-" toml:"-"`
+	SyncInterval   Duration     `json:"sync_interval" yaml:"sync_interval" toml:"sync_interval"`
+	SyncTimeout    Duration     `json:"sync_timeout" yaml:"sync_timeout" toml:"sync_timeout"`
+	StartupTimeout Duration     `json:"startup_timeout" yaml:"startup_timeout" toml:"startup_timeout"`
+	Hostname       string       `json:"hostname" yaml:"hostname" toml:"hostname"`
+	OwnerTag       string       `json:"owner_tag" yaml:"owner_tag" toml:"owner_tag"`
+	CleanupOnExit  bool         `json:"cleanup_on_exit" yaml:"cleanup_on_exit" toml:"cleanup_on_exit"`
+	HTTPAddress    string       `json:"http_address" yaml:"http_address" toml:"http_address"`
+	Backend        string       `json:"backend" yaml:"backend" toml:"backend"`
+	Docker         Docker       `json:"docker" yaml:"docker" toml:"docker"`
+	Consul         Consul       `json:"consul" yaml:"consul" toml:"consul"`
+	Etcd           Etcd         `json:"etcd" yaml:"etcd" toml:"etcd"`
+	Zookeeper      Zookeeper    `json:"zookeeper" yaml:"zookeeper" toml:"zookeeper"`
+	ServicesFile   ServicesFile `json:"file" yaml:"file" toml:"file"`
+}
+
+// Docker holds docker client settings and the way containers are registered
+type Docker struct {
+	Endpoint       string   `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+	TLSCert        string   `json:"tls_cert" yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey         string   `json:"tls_key" yaml:"tls_key" toml:"tls_key"`
+	TLSCACert      string   `json:"tls_ca_cert" yaml:"tls_ca_cert" toml:"tls_ca_cert"`
+	AddressMode    string   `json:"address_mode" yaml:"address_mode" toml:"address_mode"`
+	AdvertiseIP    string   `json:"advertise_ip" yaml:"advertise_ip" toml:"advertise_ip"`
+	Network        string   `json:"network" yaml:"network" toml:"network"`
+	InspectWorkers int      `json:"inspect_workers" yaml:"inspect_workers" toml:"inspect_workers"`
+	OptIn          bool     `json:"opt_in" yaml:"opt_in" toml:"opt_in"`
+	Naming         string   `json:"naming" yaml:"naming" toml:"naming"`
+	NameTemplate   string   `json:"name_template" yaml:"name_template" toml:"name_template"`
+	Include        []string `json:"include" yaml:"include" toml:"include"`
+	Exclude        []string `json:"exclude" yaml:"exclude" toml:"exclude"`
+}
+
+// Consul holds consul client settings
+type Consul struct {
+	Address       string `json:"address" yaml:"address" toml:"address"`
+	Scheme        string `json:"scheme" yaml:"scheme" toml:"scheme"`
+	Datacenter    string `json:"datacenter" yaml:"datacenter" toml:"datacenter"`
+	Token         string `json:"token" yaml:"token" toml:"token"`
+	TLSCAFile     string `json:"tls_ca_file" yaml:"tls_ca_file" toml:"tls_ca_file"`
+	TLSCertFile   string `json:"tls_cert_file" yaml:"tls_cert_file" toml:"tls_cert_file"`
+	TLSKeyFile    string `json:"tls_key_file" yaml:"tls_key_file" toml:"tls_key_file"`
+	TLSSkipVerify bool   `json:"tls_skip_verify" yaml:"tls_skip_verify" toml:"tls_skip_verify"`
+}
+
+// Etcd holds etcd client settings and the place where services are kept
+type Etcd struct {
+	Endpoints []string `json:"endpoints" yaml:"endpoints" toml:"endpoints"`
+	Username  string   `json:"username" yaml:"username" toml:"username"`
+	Password  string   `json:"password" yaml:"password" toml:"password"`
+	Prefix    string   `json:"prefix" yaml:"prefix" toml:"prefix"`
+	LeaseTTL  Duration `json:"lease_ttl" yaml:"lease_ttl" toml:"lease_ttl"`
+}
+
+// Zookeeper holds ZooKeeper connection settings and the Curator ServiceDiscovery base path
+type Zookeeper struct {
+	Servers        []string `json:"servers" yaml:"servers" toml:"servers"`
+	BasePath       string   `json:"base_path" yaml:"base_path" toml:"base_path"`
+	SessionTimeout Duration `json:"session_timeout" yaml:"session_timeout" toml:"session_timeout"`
+}
+
+// ServicesFile holds the path and format of file keeping services
+type ServicesFile struct {
+	Path   string `json:"path" yaml:"path" toml:"path"`
+	Format string `json:"format" yaml:"format" toml:"format"`
+}
+
+// Duration is time.Duration read from strings like "5s" in configuration files
+type Duration time.Duration
+
+// UnmarshalText parses duration from JSON and TOML strings
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// UnmarshalYAML parses duration from YAML strings
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(text))
+}
+
+// Default returns configuration used when nothing else is given
+func Default() *Config {
+	hostname, _ := os.Hostname()
+	return &Config{
+		SyncInterval:   Duration(5 * time.Second),
+		SyncTimeout:    Duration(30 * time.Second),
+		StartupTimeout: Duration(time.Minute),
+		Hostname:       hostname,
+		OwnerTag:       "pencil",
+		HTTPAddress:    "127.0.0.1:9102",
+		Output:         "table",
+		Backend:        ConsulBackend,
+		Docker: Docker{
+			AddressMode:    string(docker.ExposedPortsMode),
+			InspectWorkers: docker.DefaultInspectWorkers,
+			Naming:         string(docker.RepositoryNaming),
+		},
+		Etcd: Etcd{
+			Prefix:   "/pencil/services",
+			LeaseTTL: Duration(30 * time.Second),
+		},
+		Zookeeper: Zookeeper{
+			BasePath:       "/services",
+			SessionTimeout: Duration(10 * time.Second),
+		},
+		ServicesFile: ServicesFile{
+			Format: string(file.JSONFormat),
+		},
+	}
+}
+
+// Load resolves configuration from file, environment and command-line arguments
+func Load(args []string) (*Config, error) {
+	config := Default()
+	if path := configFilePath(args); path != "" {
+		if err := config.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	flags := config.flagSet()
+	if err := applyEnv(flags); err != nil {
+		return nil, err
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Backends returns names of service backends, services are registered in all of them
+func (c *Config) Backends() []string {
+	backends := []string{}
+	for _, backend := range strings.Split(c.Backend, ",") {
+		backends = append(backends, strings.TrimSpace(backend))
+	}
+	return backends
+}
+
+// Validate reports the first invalid setting
+func (c *Config) Validate() error {
+	if c.SyncInterval <= 0 {
+		return fmt.Errorf("sync interval must be positive, got %v", time.Duration(c.SyncInterval))
+	}
+	if c.SyncTimeout <= 0 {
+		return fmt.Errorf("sync timeout must be positive, got %v", time.Duration(c.SyncTimeout))
+	}
+	if c.StartupTimeout < 0 {
+		return fmt.Errorf("startup timeout cannot be negative, got %v", time.Duration(c.StartupTimeout))
+	}
+	if c.Output != "table" && c.Output != "json" {
+		return fmt.Errorf("unknown output format %q", c.Output)
+	}
+	if c.Hostname == "" {
+		return fmt.Errorf("hostname cannot be empty")
+	}
+	if strings.Contains(c.Hostname, ":") {
+		return fmt.Errorf("hostname cannot contain ':', got %q", c.Hostname)
+	}
+	if c.OwnerTag == "" {
+		return fmt.Errorf("owner tag cannot be empty")
+	}
+	switch docker.AddressMode(c.Docker.AddressMode) {
+	case docker.ExposedPortsMode, docker.PublishedPortsMode, docker.InternalMode:
+	default:
+		return fmt.Errorf("unknown address mode %q", c.Docker.AddressMode)
+	}
+	if c.Docker.InspectWorkers <= 0 {
+		return fmt.Errorf("docker inspect workers must be positive, got %d", c.Docker.InspectWorkers)
+	}
+	switch docker.Naming(c.Docker.Naming) {
+	case docker.RepositoryNaming, docker.PathNaming:
+	case docker.TemplateNaming:
+		if c.Docker.NameTemplate == "" {
+			return fmt.Errorf("name template is required by template naming")
+		}
+		if _, err := template.New("name").Parse(c.Docker.NameTemplate); err != nil {
+			return fmt.Errorf("invalid name template: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown naming %q", c.Docker.Naming)
+	}
+	if _, err := docker.ParseFilters(c.Docker.Include); err != nil {
+		return err
+	}
+	if _, err := docker.ParseFilters(c.Docker.Exclude); err != nil {
+		return err
+	}
+	if (c.Docker.TLSCert == "") != (c.Docker.TLSKey == "") {
+		return fmt.Errorf("docker TLS certificate and key must be given together")
+	}
+	if c.Docker.TLSCert != "" && c.Docker.Endpoint == "" {
+		return fmt.Errorf("docker endpoint is required when TLS is configured")
+	}
+	seen := map[string]bool{}
+	for _, backend := range c.Backends() {
+		if seen[backend] {
+			return fmt.Errorf("backend %q is given more than once", backend)
+		}
+		seen[backend] = true
+		if err := c.validateBackend(backend); err != nil {
+			return err
+		}
+	}
+	switch c.Consul.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("unknown consul scheme %q", c.Consul.Scheme)
+	}
+	if (c.Consul.TLSCertFile == "") != (c.Consul.TLSKeyFile == "") {
+		return fmt.Errorf("consul TLS certificate and key must be given together")
+	}
+	return nil
+}
+
+// validateBackend checks settings of single service backend
+func (c *Config) validateBackend(backend string) error {
+	switch backend {
+	case ConsulBackend:
+	case EtcdBackend:
+		if c.Etcd.Prefix == "" {
+			return fmt.Errorf("etcd prefix cannot be empty")
+		}
+		if c.Etcd.LeaseTTL < Duration(time.Second) {
+			return fmt.Errorf("etcd lease TTL must be at least 1s, got %v", time.Duration(c.Etcd.LeaseTTL))
+		}
+	case ZookeeperBackend:
+		if !strings.HasPrefix(c.Zookeeper.BasePath, "/") {
+			return fmt.Errorf("zookeeper base path must be absolute, got %q", c.Zookeeper.BasePath)
+		}
+		if c.Zookeeper.SessionTimeout < Duration(time.Second) {
+			return fmt.Errorf("zookeeper session timeout must be at least 1s, got %v", time.Duration(c.Zookeeper.SessionTimeout))
+		}
+	case FileBackend:
+		if c.ServicesFile.Path == "" {
+			return fmt.Errorf("services file path is required by file backend")
+		}
+		switch file.Format(c.ServicesFile.Format) {
+		case file.JSONFormat, file.YAMLFormat:
+		case file.FileSDFormat:
+			if docker.AddressMode(c.Docker.AddressMode) == docker.ExposedPortsMode {
+				return fmt.Errorf("file_sd format requires published or internal address mode, exposed mode registers no addresses")
+			}
+		default:
+			return fmt.Errorf("unknown services file format %q", c.ServicesFile.Format)
+		}
+	default:
+		return fmt.Errorf("unknown backend %q", backend)
+	}
+	return nil
+}
+
+func (c *Config) flagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet("pencil", flag.ContinueOnError)
+	flags.StringVar(&c.File, "config", c.File, "path to configuration file (.json, .yaml, .yml or .toml)")
+	flags.BoolVar(&c.DryRun, "dry-run", c.DryRun, "print what synchronization would change and exit without changing anything")
+	flags.StringVar(&c.Output, "output", c.Output, "format of dry run output: table or json")
+	flags.DurationVar((*time.Duration)(&c.SyncInterval), "sync-interval", time.Duration(c.SyncInterval), "interval of full synchronization")
+	flags.DurationVar((*time.Duration)(&c.SyncTimeout), "sync-timeout", time.Duration(c.SyncTimeout), "timeout of single synchronization, including deregistration on exit")
+	flags.DurationVar((*time.Duration)(&c.StartupTimeout), "startup-timeout", time.Duration(c.StartupTimeout), "how long to wait for docker and consul at startup")
+	flags.StringVar(&c.Hostname, "hostname", c.Hostname, "host name used in registered services IDs")
+	flags.StringVar(&c.OwnerTag, "owner-tag", c.OwnerTag, "tag marking services managed by pencil")
+	flags.BoolVar(&c.CleanupOnExit, "cleanup-on-exit", c.CleanupOnExit, "deregister services managed by pencil on SIGINT or SIGTERM")
+	flags.StringVar(&c.HTTPAddress, "http-address", c.HTTPAddress, "address serving /metrics and admin API, it listens on loopback by default as /sync is not authenticated, HTTP server is disabled when empty")
+
+	flags.StringVar(&c.Backend, "backend", c.Backend, "backends keeping registered services separated by commas: consul, etcd, zookeeper or file, e.g. consul,etcd during migration")
+
+	flags.StringVar(&c.Docker.Endpoint, "docker-endpoint", c.Docker.Endpoint, "docker daemon endpoint, DOCKER_HOST is used when empty")
+	flags.StringVar(&c.Docker.TLSCert, "docker-tls-cert", c.Docker.TLSCert, "docker client TLS certificate")
+	flags.StringVar(&c.Docker.TLSKey, "docker-tls-key", c.Docker.TLSKey, "docker client TLS key")
+	flags.StringVar(&c.Docker.TLSCACert, "docker-tls-ca-cert", c.Docker.TLSCACert, "docker daemon CA certificate")
+	flags.StringVar(&c.Docker.AddressMode, "address-mode", c.Docker.AddressMode, "registered address: exposed, published or internal")
+	flags.StringVar(&c.Docker.AdvertiseIP, "advertise-ip", c.Docker.AdvertiseIP, "address registered for ports published on all interfaces")
+	flags.StringVar(&c.Docker.Network, "network", c.Docker.Network, "container network used in internal address mode")
+	flags.IntVar(&c.Docker.InspectWorkers, "docker-inspect-workers", c.Docker.InspectWorkers, "number of containers inspected concurrently")
+	flags.StringVar(&c.Docker.Naming, "naming", c.Docker.Naming, "service names built from image: repository, path or template")
+	flags.StringVar(&c.Docker.NameTemplate, "name-template", c.Docker.NameTemplate, "Go template of service names used by template naming, e.g. {{.Image.Namespace}}-{{.Image.Repository}}")
+	flags.BoolVar(&c.Docker.OptIn, "opt-in", c.Docker.OptIn, "register only containers labeled with pencil.enable=true")
+	flags.Var(newStringsFlag(&c.Docker.Include), "include", "register only containers matching filter, e.g. image=redis* or name~=^web-, can be repeated")
+	flags.Var(newStringsFlag(&c.Docker.Exclude), "exclude", "skip containers matching filter, e.g. label:role=build, can be repeated")
+
+	flags.StringVar(&c.Consul.Address, "consul-address", c.Consul.Address, "consul agent address, CONSUL_HTTP_ADDR is used when empty")
+	flags.StringVar(&c.Consul.Scheme, "consul-scheme", c.Consul.Scheme, "consul agent scheme: http or https")
+	flags.StringVar(&c.Consul.Datacenter, "consul-datacenter", c.Consul.Datacenter, "consul datacenter")
+	flags.StringVar(&c.Consul.Token, "consul-token", c.Consul.Token, "consul ACL token")
+	flags.StringVar(&c.Consul.TLSCAFile, "consul-tls-ca-file", c.Consul.TLSCAFile, "consul CA certificate")
+	flags.StringVar(&c.Consul.TLSCertFile, "consul-tls-cert-file", c.Consul.TLSCertFile, "consul client TLS certificate")
+	flags.StringVar(&c.Consul.TLSKeyFile, "consul-tls-key-file", c.Consul.TLSKeyFile, "consul client TLS key")
+	flags.BoolVar(&c.Consul.TLSSkipVerify, "consul-tls-skip-verify", c.Consul.TLSSkipVerify, "skip verification of consul certificate")
+
+	flags.Var(newStringsFlag(&c.Etcd.Endpoints), "etcd-endpoint", "etcd endpoint, can be repeated, localhost:2379 is used when not given")
+	flags.StringVar(&c.Etcd.Username, "etcd-username", c.Etcd.Username, "etcd user name")
+	flags.StringVar(&c.Etcd.Password, "etcd-password", c.Etcd.Password, "etcd password")
+	flags.StringVar(&c.Etcd.Prefix, "etcd-prefix", c.Etcd.Prefix, "etcd key prefix of services, services of the host are kept under <prefix>/<hostname>/")
+	flags.DurationVar((*time.Duration)(&c.Etcd.LeaseTTL), "etcd-lease-ttl", time.Duration(c.Etcd.LeaseTTL), "how long services of stopped pencil are kept in etcd")
+
+	flags.Var(newStringsFlag(&c.Zookeeper.Servers), "zookeeper-server", "zookeeper server address, can be repeated, localhost:2181 is used when not given")
+	flags.StringVar(&c.Zookeeper.BasePath, "zookeeper-base-path", c.Zookeeper.BasePath, "zookeeper path of Curator service discovery, services are kept under <base path>/<service name>/")
+	flags.DurationVar((*time.Duration)(&c.Zookeeper.SessionTimeout), "zookeeper-session-timeout", time.Duration(c.Zookeeper.SessionTimeout), "how long services of stopped pencil are kept in zookeeper")
+
+	flags.StringVar(&c.ServicesFile.Path, "file-path", c.ServicesFile.Path, "path of file keeping services, it is replaced atomically on every change")
+	flags.StringVar(&c.ServicesFile.Format, "file-format", c.ServicesFile.Format, "format of services file: json, yaml or file_sd for Prometheus file_sd_configs")
+	return flags
+}
+
+// stringsFlag collects values of repeated flag, values of the first flag given
+// replace values loaded from configuration file or environment
+type stringsFlag struct {
+	values *[]string
+	set    bool
+}
+
+func newStringsFlag(values *[]string) *stringsFlag {
+	return &stringsFlag{values: values}
+}
+
+func (s *stringsFlag) String() string {
+	if s == nil || s.values == nil {
+		return ""
+	}
+	return strings.Join(*s.values, " ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	if !s.set {
+		*s.values = nil
+		s.set = true
+	}
+	*s.values = append(*s.values, value)
+	return nil
+}
+
+func (c *Config) loadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// unknown keys are rejected, so misspelled setting is not silently left at its default
+	switch filepath.Ext(path) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(c)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(content, c)
+	case ".toml":
+		var metadata toml.MetaData
+		metadata, err = toml.Decode(string(content), c)
+		if undecoded := metadata.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown keys %v", undecoded)
+		}
+	default:
+		return fmt.Errorf("unknown format of configuration file %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot parse configuration file %s: %v", path, err)
+	}
+	return nil
+}
+
+// configFilePath finds configuration file before the rest of arguments is applied,
+// errors are reported when arguments are parsed again
+func configFilePath(args []string) string {
+	config := Default()
+	flags := config.flagSet()
+	flags.SetOutput(ioutil.Discard)
+	applyEnv(flags)
+	flags.Parse(args)
+	return config.File
+}
+
+func applyEnv(flags *flag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, exist := os.LookupEnv(name); exist && err == nil {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q of %s: %v", value, name, setErr)
+			}
+		}
+	})
+	// flags are parsed after environment, so they replace repeated values set by it
+	flags.VisitAll(func(f *flag.Flag) {
+		if values, ok := f.Value.(*stringsFlag); ok {
+			values.set = false
+		}
+	})
+	return err
+}
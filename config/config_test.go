@@ -0,0 +1,230 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadWithoutSettingsReturnsDefaults(t *testing.T) {
+	config, err := Load([]string{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, Default(), config)
+	assert.Equal(t, "127.0.0.1:9102", config.HTTPAddress)
+}
+
+func TestLoadAppliesFileEnvironmentAndFlagsInOrder(t *testing.T) {
+	path := writeConfigFile(t, "pencil.yaml", `
+sync_interval: 30s
+hostname: node1
+owner_tag: from-file
+docker:
+  address_mode: published
+  advertise_ip: 10.0.0.1
+consul:
+  address: consul.local:8500
+  datacenter: dc1
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	setEnv(t, "PENCIL_OWNER_TAG", "from-env")
+	setEnv(t, "PENCIL_CONSUL_DATACENTER", "dc2")
+
+	config, err := Load([]string{"-config", path, "-consul-datacenter", "dc3"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, Duration(30*time.Second), config.SyncInterval)
+	assert.Equal(t, "node1", config.Hostname)
+	assert.Equal(t, "from-env", config.OwnerTag)
+	assert.Equal(t, "published", config.Docker.AddressMode)
+	assert.Equal(t, "10.0.0.1", config.Docker.AdvertiseIP)
+	assert.Equal(t, "consul.local:8500", config.Consul.Address)
+	assert.Equal(t, "dc3", config.Consul.Datacenter)
+}
+
+func TestLoadReadsJSONAndTOMLFiles(t *testing.T) {
+	jsonPath := writeConfigFile(t, "pencil.json", `{"sync_interval": "1m", "docker": {"network": "overlay"}}`)
+	defer os.RemoveAll(filepath.Dir(jsonPath))
+	tomlPath := writeConfigFile(t, "pencil.toml", "sync_interval = \"2m\"\n[consul]\ntoken = \"secret\"\n")
+	defer os.RemoveAll(filepath.Dir(tomlPath))
+
+	config, err := Load([]string{"-config", jsonPath})
+	assert.Nil(t, err)
+	assert.Equal(t, Duration(time.Minute), config.SyncInterval)
+	assert.Equal(t, "overlay", config.Docker.Network)
+
+	config, err = Load([]string{"-config", tomlPath})
+	assert.Nil(t, err)
+	assert.Equal(t, Duration(2*time.Minute), config.SyncInterval)
+	assert.Equal(t, "secret", config.Consul.Token)
+}
+
+func TestLoadCollectsRepeatedFilters(t *testing.T) {
+	path := writeConfigFile(t, "pencil.json", `{"docker": {"include": ["label:team=web"], "exclude": ["label:role=build"]}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := Load([]string{"-config", path, "-include", "image=brainly/*", "-include", "name~=^web-"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"image=brainly/*", "name~=^web-"}, config.Docker.Include)
+	assert.Equal(t, []string{"label:role=build"}, config.Docker.Exclude)
+}
+
+func TestLoadRepeatedFlagsOverrideEnvironment(t *testing.T) {
+	setEnv(t, "PENCIL_EXCLUDE", "label:role=build")
+	path := writeConfigFile(t, "pencil.json", `{"docker": {"exclude": ["name=db"]}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	fromEnv, err := Load([]string{"-config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"label:role=build"}, fromEnv.Docker.Exclude)
+
+	fromFlags, err := Load([]string{"-config", path, "-exclude", "name=cron", "-exclude", "name=batch"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"name=cron", "name=batch"}, fromFlags.Docker.Exclude)
+}
+
+func TestLoadEtcdBackend(t *testing.T) {
+	path := writeConfigFile(t, "pencil.yaml", `
+backend: etcd
+etcd:
+  endpoints: [etcd1:2379, etcd2:2379]
+  lease_ttl: 1m
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := Load([]string{"-config", path, "-etcd-prefix", "/services"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, EtcdBackend, config.Backend)
+	assert.Equal(t, Etcd{Endpoints: []string{"etcd1:2379", "etcd2:2379"}, Prefix: "/services", LeaseTTL: Duration(time.Minute)}, config.Etcd)
+}
+
+func TestLoadZookeeperBackend(t *testing.T) {
+	path := writeConfigFile(t, "pencil.toml", `
+backend = "zookeeper"
+
+[zookeeper]
+servers = ["zk1:2181", "zk2:2181"]
+session_timeout = "30s"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := Load([]string{"-config", path})
+
+	assert.Nil(t, err)
+	assert.Equal(t, ZookeeperBackend, config.Backend)
+	assert.Equal(t, Zookeeper{Servers: []string{"zk1:2181", "zk2:2181"}, BasePath: "/services", SessionTimeout: Duration(30 * time.Second)}, config.Zookeeper)
+}
+
+func TestLoadFileBackend(t *testing.T) {
+	setEnv(t, "PENCIL_FILE_PATH", "/etc/prometheus/targets/pencil.json")
+
+	config, err := Load([]string{"-backend", "file", "-file-format", "file_sd", "-address-mode", "published"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, ServicesFile{Path: "/etc/prometheus/targets/pencil.json", Format: "file_sd"}, config.ServicesFile)
+}
+
+func TestLoadMultipleBackends(t *testing.T) {
+	config, err := Load([]string{"-backend", "consul, etcd"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ConsulBackend, EtcdBackend}, config.Backends())
+}
+
+func TestLoadFailsOnInvalidConfiguration(t *testing.T) {
+	_, err := Load([]string{"-sync-interval", "0s"})
+	assert.EqualError(t, err, "sync interval must be positive, got 0s")
+
+	_, err = Load([]string{"-address-mode", "bridge"})
+	assert.EqualError(t, err, `unknown address mode "bridge"`)
+
+	_, err = Load([]string{"-backend", "eureka"})
+	assert.EqualError(t, err, `unknown backend "eureka"`)
+
+	_, err = Load([]string{"-backend", "etcd", "-etcd-lease-ttl", "500ms"})
+	assert.EqualError(t, err, "etcd lease TTL must be at least 1s, got 500ms")
+
+	_, err = Load([]string{"-backend", "zookeeper", "-zookeeper-base-path", "services"})
+	assert.EqualError(t, err, `zookeeper base path must be absolute, got "services"`)
+
+	_, err = Load([]string{"-backend", "consul,eureka"})
+	assert.EqualError(t, err, `unknown backend "eureka"`)
+
+	_, err = Load([]string{"-backend", "consul,consul"})
+	assert.EqualError(t, err, `backend "consul" is given more than once`)
+
+	_, err = Load([]string{"-backend", "file"})
+	assert.EqualError(t, err, "services file path is required by file backend")
+
+	_, err = Load([]string{"-backend", "file", "-file-path", "/tmp/services", "-file-format", "xml"})
+	assert.EqualError(t, err, `unknown services file format "xml"`)
+
+	_, err = Load([]string{"-backend", "file", "-file-path", "/tmp/targets.json", "-file-format", "file_sd"})
+	assert.EqualError(t, err, "file_sd format requires published or internal address mode, exposed mode registers no addresses")
+
+	_, err = Load([]string{"-naming", "image"})
+	assert.EqualError(t, err, `unknown naming "image"`)
+
+	_, err = Load([]string{"-naming", "template", "-name-template", "{{.Image"})
+	assert.Error(t, err)
+
+	_, err = Load([]string{"-include", "redis"})
+	assert.EqualError(t, err, `invalid filter "redis", expected <field>=<pattern>`)
+
+	_, err = Load([]string{"-dry-run", "-output", "yaml"})
+	assert.EqualError(t, err, `unknown output format "yaml"`)
+
+	_, err = Load([]string{"-docker-inspect-workers", "0"})
+	assert.EqualError(t, err, "docker inspect workers must be positive, got 0")
+
+	_, err = Load([]string{"-docker-endpoint", "tcp://docker:2376", "-docker-tls-cert", "cert.pem"})
+	assert.EqualError(t, err, "docker TLS certificate and key must be given together")
+
+	_, err = Load([]string{"-config", "pencil.ini"})
+	assert.Error(t, err)
+
+	setEnv(t, "PENCIL_SYNC_INTERVAL", "often")
+	_, err = Load([]string{})
+	assert.Error(t, err)
+}
+
+func TestLoadFailsOnUnknownKeysInFile(t *testing.T) {
+	files := map[string]string{
+		"pencil.json": `{"sync_intreval": "1m"}`,
+		"pencil.yaml": "consul:\n  adress: consul.local:8500\n",
+		"pencil.toml": "[docker]\naddres_mode = \"published\"\n",
+	}
+	for name, content := range files {
+		path := writeConfigFile(t, name, content)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		_, err := Load([]string{"-config", path})
+
+		assert.Error(t, err, name)
+	}
+}
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "pencil")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func setEnv(t *testing.T, name string, value string) {
+	previous, existed := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if existed {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
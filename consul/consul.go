@@ -1,53 +1,227 @@
 package consul
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/alaa/pencil-go/registry"
 	consul "github.com/hashicorp/consul/api"
+	"strings"
 )
 
-// ServiceRepository is consul-based implementation of registry.ServiceRepository
+const (
+	defaultCheckInterval = "10s"
+	defaultCheckHost     = "localhost"
+	// checkMetaKey keeps check definition as requested by pencil,
+	// consul reports checks in the form which cannot be compared with it.
+	// Definitions longer than a metadata value continue in "pencil_check_1", "pencil_check_2", ...
+	checkMetaKey = "pencil_check"
+	// maxMetaValueLength is the longest metadata value accepted by consul agent
+	maxMetaValueLength = 512
+	// maxCheckMetaPairs limits metadata pairs taken by check definition, docker metadata leaves room for them
+	maxCheckMetaPairs = 4
+)
+
+// ServiceRepository is consul-based implementation of registry.ServiceRepository,
+// it marks registered services with owner tag and manages only services having it
 type ServiceRepository struct {
 	consulAgent consulAgent
+	ownerTag    string
 }
 
 type consulAgent interface {
-	Services() (map[string]*consul.AgentService, error)
-	ServiceRegister(service *consul.AgentServiceRegistration) error
-	ServiceDeregister(serviceID string) error
+	ServicesWithFilterOpts(filter string, q *consul.QueryOptions) (map[string]*consul.AgentService, error)
+	ServiceRegisterOpts(service *consul.AgentServiceRegistration, opts consul.ServiceRegisterOpts) error
+	ServiceDeregisterOpts(serviceID string, q *consul.QueryOptions) error
 }
 
 // NewServiceRepository creates new instance of ServiceRepository structure
-func NewServiceRepository(consulAgent consulAgent) *ServiceRepository {
-	return &ServiceRepository{consulAgent}
+func NewServiceRepository(consulAgent consulAgent, ownerTag string) *ServiceRepository {
+	return &ServiceRepository{instrumentedAgent{consulAgent}, ownerTag}
 }
 
-// Register adds service into consul
-func (r *ServiceRepository) Register(service *registry.Service) error {
-	return r.consulAgent.ServiceRegister(
-		buildAgentServiceRegistration(service),
-	)
+// Register adds or updates service in consul, checks which are no longer defined are removed
+func (r *ServiceRepository) Register(ctx context.Context, service *registry.Service) error {
+	registration, err := buildAgentServiceRegistration(service)
+	if err != nil {
+		return err
+	}
+	registration.Tags = append(append([]string{}, service.Tags...), r.ownerTag)
+	opts := consul.ServiceRegisterOpts{ReplaceExistingChecks: true}
+	return r.consulAgent.ServiceRegisterOpts(registration, opts.WithContext(ctx))
 }
 
 // Deregister removes service from consul
-func (r *ServiceRepository) Deregister(serviceID string) error {
-	return r.consulAgent.ServiceDeregister(serviceID)
+func (r *ServiceRepository) Deregister(ctx context.Context, serviceID string) error {
+	return r.consulAgent.ServiceDeregisterOpts(serviceID, (&consul.QueryOptions{}).WithContext(ctx))
+}
+
+// GetAll returns services registered in consul by pencil
+func (r *ServiceRepository) GetAll(ctx context.Context) ([]*registry.Service, error) {
+	agentServices, err := r.consulAgent.ServicesWithFilterOpts("", (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	services := []*registry.Service{}
+	for _, agentService := range agentServices {
+		if r.isOwned(agentService) {
+			services = append(services, r.buildService(agentService))
+		}
+	}
+	return services, nil
+}
+
+func (r *ServiceRepository) buildService(agentService *consul.AgentService) *registry.Service {
+	service := &registry.Service{
+		ID:      agentService.ID,
+		Service: agentService.Service,
+		Address: agentService.Address,
+		Port:    agentService.Port,
+		Tags:    []string{},
+	}
+	for _, tag := range agentService.Tags {
+		if tag != r.ownerTag {
+			service.Tags = append(service.Tags, tag)
+		}
+	}
+	check := agentService.Meta[checkMetaKey]
+	for i := 1; i < maxCheckMetaPairs; i++ {
+		check += agentService.Meta[checkChunkKey(i)]
+	}
+	if check != "" {
+		json.Unmarshal([]byte(check), &service.Check)
+	}
+	for key, value := range agentService.Meta {
+		if isCheckMetaKey(key) {
+			continue
+		}
+		if service.Meta == nil {
+			service.Meta = map[string]string{}
+		}
+		service.Meta[key] = value
+	}
+	return service
 }
 
-// GetAllIds return array of services ids registered in consul
-func (r *ServiceRepository) GetAllIds() []string {
-	services, _ := r.consulAgent.Services()
-	servicesIDs := []string{}
-	for _, service := range services {
-		servicesIDs = append(servicesIDs, service.ID)
+func (r *ServiceRepository) isOwned(service *consul.AgentService) bool {
+	for _, tag := range service.Tags {
+		if tag == r.ownerTag {
+			return true
+		}
 	}
-	return servicesIDs
+	return false
 }
 
-func buildAgentServiceRegistration(service *registry.Service) *consul.AgentServiceRegistration {
+func buildAgentServiceRegistration(service *registry.Service) (*consul.AgentServiceRegistration, error) {
+	meta, err := buildMeta(service)
+	if err != nil {
+		return nil, err
+	}
 	return &consul.AgentServiceRegistration{
-		ID:   service.ID,
-		Name: service.Service,
-		Port: service.Port,
-		Tags: service.Tags,
+		ID:      service.ID,
+		Name:    service.Service,
+		Address: service.Address,
+		Port:    service.Port,
+		Tags:    service.Tags,
+		Meta:    meta,
+		Check:   buildAgentServiceCheck(service),
+	}, nil
+}
+
+// buildMeta returns metadata of service extended with its check definition,
+// the definition is split into values accepted by consul
+func buildMeta(service *registry.Service) (map[string]string, error) {
+	if service.Check == (registry.ServiceCheck{}) && len(service.Meta) == 0 {
+		return nil, nil
+	}
+	meta := map[string]string{}
+	for key, value := range service.Meta {
+		meta[key] = value
+	}
+	if service.Check == (registry.ServiceCheck{}) {
+		return meta, nil
+	}
+	check, _ := json.Marshal(service.Check)
+	if len(check) > maxCheckMetaPairs*maxMetaValueLength {
+		return nil, fmt.Errorf("check definition of service %s is longer than %d characters", service.ID, maxCheckMetaPairs*maxMetaValueLength)
+	}
+	for i := 0; len(check) > 0; i++ {
+		chunk := check
+		if len(chunk) > maxMetaValueLength {
+			chunk = chunk[:maxMetaValueLength]
+		}
+		meta[checkChunkKey(i)] = string(chunk)
+		check = check[len(chunk):]
+	}
+	return meta, nil
+}
+
+// checkChunkKey returns metadata key of i-th part of check definition
+func checkChunkKey(i int) string {
+	if i == 0 {
+		return checkMetaKey
+	}
+	return fmt.Sprintf("%s_%d", checkMetaKey, i)
+}
+
+func isCheckMetaKey(key string) bool {
+	for i := 0; i < maxCheckMetaPairs; i++ {
+		if key == checkChunkKey(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildAgentServiceCheck returns nil when service has no health check defined
+func buildAgentServiceCheck(service *registry.Service) *consul.AgentServiceCheck {
+	check := service.Check
+	agentCheck := &consul.AgentServiceCheck{
+		Interval: check.Interval,
+		Timeout:  check.Timeout,
+	}
+	if agentCheck.Interval == "" {
+		agentCheck.Interval = defaultCheckInterval
+	}
+
+	switch {
+	case check.HTTP != "":
+		agentCheck.HTTP = checkURL(service, check.HTTP)
+	case check.TCP != "":
+		agentCheck.TCP = checkAddress(service, check.TCP)
+	case check.Script != "":
+		agentCheck.Args = []string{"/bin/sh", "-c", check.Script}
+	case check.TTL != "":
+		agentCheck.TTL = check.TTL
+		agentCheck.Interval = ""
+		agentCheck.Timeout = ""
+	default:
+		return nil
+	}
+	return agentCheck
+}
+
+func checkURL(service *registry.Service, http string) string {
+	if strings.Contains(http, "://") {
+		return http
+	}
+	if !strings.HasPrefix(http, "/") {
+		http = "/" + http
+	}
+	return fmt.Sprintf("http://%s%s", serviceHostPort(service), http)
+}
+
+func checkAddress(service *registry.Service, tcp string) string {
+	if tcp == "true" {
+		return serviceHostPort(service)
+	}
+	return tcp
+}
+
+func serviceHostPort(service *registry.Service) string {
+	host := service.Address
+	if host == "" {
+		host = defaultCheckHost
 	}
+	return fmt.Sprintf("%s:%d", host, service.Port)
 }
@@ -1,26 +1,34 @@
 package consul
 
 import (
+	"context"
+	"errors"
 	"github.com/alaa/pencil-go/registry"
 	consul "github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"sort"
+	"strings"
 	"testing"
 )
 
+var (
+	registerOpts = consul.ServiceRegisterOpts{ReplaceExistingChecks: true}.WithContext(context.Background())
+	queryOptions = (&consul.QueryOptions{}).WithContext(context.Background())
+)
+
 func TestThatRegisterCallConsulApiRegister(t *testing.T) {
 	consulAgent := new(MockConsulAgent)
-	consulServiceRepository := NewServiceRepository(consulAgent)
+	consulServiceRepository := NewServiceRepository(consulAgent, "pencil")
 
-	consulAgent.On("ServiceRegister", &consul.AgentServiceRegistration{
+	consulAgent.On("ServiceRegisterOpts", &consul.AgentServiceRegistration{
 		ID:   "redis1",
 		Name: "redis",
 		Port: 8000,
-		Tags: []string{"tag1", "tag2"},
-	}).Return(nil)
+		Tags: []string{"tag1", "tag2", "pencil"},
+	}, registerOpts).Return(nil)
 
-	err := consulServiceRepository.Register(&registry.Service{
+	err := consulServiceRepository.Register(context.Background(), &registry.Service{
 		ID:      "redis1",
 		Service: "redis",
 		Port:    8000,
@@ -31,59 +39,288 @@ func TestThatRegisterCallConsulApiRegister(t *testing.T) {
 	consulAgent.AssertExpectations(t)
 }
 
+func TestThatRegisterPassesHealthCheckToConsul(t *testing.T) {
+	consulAgent := new(MockConsulAgent)
+	consulServiceRepository := NewServiceRepository(consulAgent, "pencil")
+
+	consulAgent.On("ServiceRegisterOpts", &consul.AgentServiceRegistration{
+		ID:   "redis1",
+		Name: "redis",
+		Port: 8000,
+		Tags: []string{"pencil"},
+		Meta: map[string]string{
+			"pencil_check": `{"Script":"","HTTP":"/health","TCP":"","Interval":"","Timeout":"1s","TTL":""}`,
+		},
+		Check: &consul.AgentServiceCheck{
+			HTTP:     "http://localhost:8000/health",
+			Interval: "10s",
+			Timeout:  "1s",
+		},
+	}, registerOpts).Return(nil)
+
+	err := consulServiceRepository.Register(context.Background(), &registry.Service{
+		ID:      "redis1",
+		Service: "redis",
+		Port:    8000,
+		Check:   registry.ServiceCheck{HTTP: "/health", Timeout: "1s"},
+	})
+
+	assert.Nil(t, err)
+	consulAgent.AssertExpectations(t)
+}
+
+func TestThatRegisterPassesServiceAddressToConsul(t *testing.T) {
+	consulAgent := new(MockConsulAgent)
+	consulServiceRepository := NewServiceRepository(consulAgent, "pencil")
+
+	consulAgent.On("ServiceRegisterOpts", &consul.AgentServiceRegistration{
+		ID:      "redis1",
+		Name:    "redis",
+		Address: "10.0.0.1",
+		Port:    8080,
+		Tags:    []string{"pencil"},
+	}, registerOpts).Return(nil)
+
+	err := consulServiceRepository.Register(context.Background(), &registry.Service{
+		ID:      "redis1",
+		Service: "redis",
+		Address: "10.0.0.1",
+		Port:    8080,
+	})
+
+	assert.Nil(t, err)
+	consulAgent.AssertExpectations(t)
+}
+
+func TestBuildAgentServiceCheck(t *testing.T) {
+	service := &registry.Service{Address: "10.0.0.1", Port: 8000}
+
+	service.Check = registry.ServiceCheck{HTTP: "https://example.com/ping", Interval: "5s"}
+	assert.Equal(t, &consul.AgentServiceCheck{HTTP: "https://example.com/ping", Interval: "5s"}, buildAgentServiceCheck(service))
+
+	service.Check = registry.ServiceCheck{TCP: "true"}
+	assert.Equal(t, &consul.AgentServiceCheck{TCP: "10.0.0.1:8000", Interval: "10s"}, buildAgentServiceCheck(service))
+
+	service.Check = registry.ServiceCheck{Script: "redis-cli ping"}
+	assert.Equal(t, &consul.AgentServiceCheck{Args: []string{"/bin/sh", "-c", "redis-cli ping"}, Interval: "10s"}, buildAgentServiceCheck(service))
+
+	service.Check = registry.ServiceCheck{TTL: "30s", Interval: "5s"}
+	assert.Equal(t, &consul.AgentServiceCheck{TTL: "30s"}, buildAgentServiceCheck(service))
+
+	service.Check = registry.ServiceCheck{Interval: "5s"}
+	assert.Nil(t, buildAgentServiceCheck(service))
+}
+
 func TestThatDeregisterCallConsulApiDeregister(t *testing.T) {
 	consulAgent := new(MockConsulAgent)
-	consulServiceRepository := NewServiceRepository(consulAgent)
+	consulServiceRepository := NewServiceRepository(consulAgent, "pencil")
+
+	consulAgent.On("ServiceDeregisterOpts", "redis1", queryOptions).Return(nil)
 
-	consulAgent.On("ServiceDeregister", "redis1").Return(nil)
+	err := consulServiceRepository.Deregister(context.Background(), "redis1")
+	assert.Nil(t, err)
+	consulAgent.AssertExpectations(t)
+}
+
+func TestThatRegisterPassesMetadataWithHealthCheckToConsul(t *testing.T) {
+	consulAgent := new(MockConsulAgent)
+	consulServiceRepository := NewServiceRepository(consulAgent, "pencil")
+
+	consulAgent.On("ServiceRegisterOpts", &consul.AgentServiceRegistration{
+		ID:   "redis1",
+		Name: "redis",
+		Port: 8000,
+		Tags: []string{"pencil"},
+		Meta: map[string]string{
+			"version":      "1.2",
+			"image":        "redis:6",
+			"pencil_check": `{"Script":"","HTTP":"","TCP":"true","Interval":"","Timeout":"","TTL":""}`,
+		},
+		Check: &consul.AgentServiceCheck{
+			TCP:      "localhost:8000",
+			Interval: "10s",
+		},
+	}, registerOpts).Return(nil)
+
+	err := consulServiceRepository.Register(context.Background(), &registry.Service{
+		ID:      "redis1",
+		Service: "redis",
+		Port:    8000,
+		Meta:    map[string]string{"version": "1.2", "image": "redis:6"},
+		Check:   registry.ServiceCheck{TCP: "true"},
+	})
 
-	err := consulServiceRepository.Deregister("redis1")
 	assert.Nil(t, err)
 	consulAgent.AssertExpectations(t)
 }
 
+func TestThatGetAllReturnsMetadataWithoutHealthCheck(t *testing.T) {
+	consulAgent := new(MockConsulAgent)
+	consulServiceRepository := NewServiceRepository(consulAgent, "pencil")
+
+	consulAgent.On("ServicesWithFilterOpts", "", queryOptions).Return(map[string]*consul.AgentService{
+		"redis": &consul.AgentService{
+			ID:      "redis",
+			Service: "redis",
+			Port:    8000,
+			Tags:    []string{"pencil"},
+			Meta: map[string]string{
+				"version":      "1.2",
+				"pencil_check": `{"TCP":"true"}`,
+			},
+		},
+	}, nil)
+
+	services, err := consulServiceRepository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*registry.Service{
+		&registry.Service{
+			ID:      "redis",
+			Service: "redis",
+			Port:    8000,
+			Tags:    []string{},
+			Meta:    map[string]string{"version": "1.2"},
+			Check:   registry.ServiceCheck{TCP: "true"},
+		},
+	}, services)
+}
+
+func TestThatLongHealthCheckIsSplitAcrossMetadataValues(t *testing.T) {
+	consulAgent := new(MockConsulAgent)
+	consulServiceRepository := NewServiceRepository(consulAgent, "pencil")
+	service := &registry.Service{
+		ID:      "redis1",
+		Service: "redis",
+		Port:    8000,
+		Tags:    []string{},
+		Check:   registry.ServiceCheck{Script: strings.Repeat("x", 1000)},
+	}
+	var meta map[string]string
+
+	consulAgent.On("ServiceRegisterOpts", mock.Anything, registerOpts).Return(nil).Run(func(args mock.Arguments) {
+		meta = args.Get(0).(*consul.AgentServiceRegistration).Meta
+	})
+	assert.Nil(t, consulServiceRepository.Register(context.Background(), service))
+
+	assert.Len(t, meta, 3)
+	for _, value := range meta {
+		assert.True(t, len(value) <= 512)
+	}
+	consulAgent.On("ServicesWithFilterOpts", "", queryOptions).Return(map[string]*consul.AgentService{
+		"redis1": &consul.AgentService{ID: "redis1", Service: "redis", Port: 8000, Tags: []string{"pencil"}, Meta: meta},
+	}, nil)
+	services, err := consulServiceRepository.GetAll(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []*registry.Service{service}, services)
+}
+
+func TestThatRegisterFailsWhenHealthCheckDoesNotFitIntoMetadata(t *testing.T) {
+	consulAgent := new(MockConsulAgent)
+	consulServiceRepository := NewServiceRepository(consulAgent, "pencil")
+
+	err := consulServiceRepository.Register(context.Background(), &registry.Service{
+		ID:      "redis1",
+		Service: "redis",
+		Check:   registry.ServiceCheck{Script: strings.Repeat("x", 2048)},
+	})
+
+	assert.EqualError(t, err, "check definition of service redis1 is longer than 2048 characters")
+	consulAgent.AssertNotCalled(t, "ServiceRegisterOpts", mock.Anything, mock.Anything)
+}
+
 type MockConsulAgent struct {
 	mock.Mock
 }
 
-func TestThatGetAllIdsReturnArrayOfServicesIds(t *testing.T) {
+func TestThatGetAllReturnsServicesOwnedByPencil(t *testing.T) {
 	consulAgent := new(MockConsulAgent)
-	consulServiceRepository := NewServiceRepository(consulAgent)
+	consulServiceRepository := NewServiceRepository(consulAgent, "pencil")
 
-	consulAgent.On("Services").Return(map[string]*consul.AgentService{
+	consulAgent.On("ServicesWithFilterOpts", "", queryOptions).Return(map[string]*consul.AgentService{
 		"redis": &consul.AgentService{
 			ID:      "redis",
 			Service: "redis",
 			Address: "",
 			Port:    8000,
+			Tags:    []string{"pencil"},
+			Meta: map[string]string{
+				"pencil_check": `{"HTTP":"/health","Interval":"5s"}`,
+			},
 		},
 		"memcached": &consul.AgentService{
 			ID:      "memcached",
 			Service: "memcached",
-			Address: "",
+			Address: "10.0.0.1",
 			Port:    9000,
+			Tags:    []string{"cache", "pencil"},
+		},
+		"consul": &consul.AgentService{
+			ID:      "consul",
+			Service: "consul",
+			Port:    8300,
+			Tags:    []string{},
+		},
+		"manual": &consul.AgentService{
+			ID:      "manual",
+			Service: "manual",
+			Port:    7000,
+			Tags:    []string{"cache"},
 		},
 	}, nil)
 
-	expectedArrayIds := []string{"memcached", "redis"}
-	servicesIds := consulServiceRepository.GetAllIds()
-	sort.Strings(servicesIds)
-	assert.Equal(t, expectedArrayIds, servicesIds)
+	expectedServices := []*registry.Service{
+		&registry.Service{
+			ID:      "memcached",
+			Service: "memcached",
+			Address: "10.0.0.1",
+			Port:    9000,
+			Tags:    []string{"cache"},
+		},
+		&registry.Service{
+			ID:      "redis",
+			Service: "redis",
+			Port:    8000,
+			Tags:    []string{},
+			Check:   registry.ServiceCheck{HTTP: "/health", Interval: "5s"},
+		},
+	}
+	services, err := consulServiceRepository.GetAll(context.Background())
+	sort.Sort(byID(services))
+	assert.Nil(t, err)
+	assert.Equal(t, expectedServices, services)
 
 	consulAgent.AssertExpectations(t)
 }
 
-func (mca *MockConsulAgent) Services() (map[string]*consul.AgentService, error) {
-	args := mca.Called()
+func TestThatGetAllReturnsErrorWhenConsulFails(t *testing.T) {
+	consulAgent := new(MockConsulAgent)
+	consulServiceRepository := NewServiceRepository(consulAgent, "pencil")
+	expectedError := errors.New("connection refused")
+
+	consulAgent.On("ServicesWithFilterOpts", "", queryOptions).Return(map[string]*consul.AgentService{}, expectedError)
+
+	_, err := consulServiceRepository.GetAll(context.Background())
+	assert.Equal(t, expectedError, err)
+}
+
+type byID []*registry.Service
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+func (mca *MockConsulAgent) ServicesWithFilterOpts(filter string, q *consul.QueryOptions) (map[string]*consul.AgentService, error) {
+	args := mca.Called(filter, q)
 	return args.Get(0).(map[string]*consul.AgentService), args.Error(1)
 }
 
-func (mca *MockConsulAgent) ServiceRegister(service *consul.AgentServiceRegistration) error {
-	args := mca.Called(service)
+func (mca *MockConsulAgent) ServiceRegisterOpts(service *consul.AgentServiceRegistration, opts consul.ServiceRegisterOpts) error {
+	args := mca.Called(service, opts)
 	return args.Error(0)
 }
 
-func (mca *MockConsulAgent) ServiceDeregister(serviceID string) error {
-	args := mca.Called(serviceID)
+func (mca *MockConsulAgent) ServiceDeregisterOpts(serviceID string, q *consul.QueryOptions) error {
+	args := mca.Called(serviceID, q)
 	return args.Error(0)
 }
@@ -0,0 +1,35 @@
+package consul
+
+import (
+	"github.com/alaa/pencil-go/metrics"
+	consul "github.com/hashicorp/consul/api"
+	"time"
+)
+
+const backend = "consul"
+
+// instrumentedAgent records latency and failures of consul agent calls
+type instrumentedAgent struct {
+	consulAgent
+}
+
+func (a instrumentedAgent) ServicesWithFilterOpts(filter string, q *consul.QueryOptions) (map[string]*consul.AgentService, error) {
+	start := time.Now()
+	services, err := a.consulAgent.ServicesWithFilterOpts(filter, q)
+	metrics.ObserveCall(backend, "services", start, err)
+	return services, err
+}
+
+func (a instrumentedAgent) ServiceRegisterOpts(service *consul.AgentServiceRegistration, opts consul.ServiceRegisterOpts) error {
+	start := time.Now()
+	err := a.consulAgent.ServiceRegisterOpts(service, opts)
+	metrics.ObserveCall(backend, "register", start, err)
+	return err
+}
+
+func (a instrumentedAgent) ServiceDeregisterOpts(serviceID string, q *consul.QueryOptions) error {
+	start := time.Now()
+	err := a.consulAgent.ServiceDeregisterOpts(serviceID, q)
+	metrics.ObserveCall(backend, "deregister", start, err)
+	return err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/alaa/pencil-go/config"
+	"github.com/alaa/pencil-go/docker"
+	"github.com/alaa/pencil-go/registry"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// daemon synchronizes services with containers until it is stopped by a signal
+type daemon struct {
+	cfg                 *config.Config
+	containerRepository *docker.ContainerRepository
+	registry            *registry.Registry
+	serviceBackend      *serviceBackend
+	backends            []backend
+	status              *syncStatus
+	// syncRequests carries synchronizations requested over HTTP into the synchronization loop
+	syncRequests chan chan syncResult
+}
+
+// syncStatus keeps result of the last full synchronization for readiness checks
+type syncStatus struct {
+	mutex sync.Mutex
+	time  time.Time
+	err   error
+}
+
+type syncResult struct {
+	report *registry.Report
+	err    error
+}
+
+func newDaemon(cfg *config.Config) (*daemon, error) {
+	dockerClient, err := newDockerClient(cfg.Docker)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create docker client: %v", err)
+	}
+	containerRepository, err := getContainerRepository(cfg, dockerClient)
+	if err != nil {
+		return nil, err
+	}
+	serviceBackend, err := newServiceBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	backends := append([]backend{{"docker", dockerClient.PingWithContext}}, serviceBackend.backends...)
+	if err := waitForBackends(backends, time.Duration(cfg.StartupTimeout)); err != nil {
+		serviceBackend.close()
+		return nil, err
+	}
+
+	return &daemon{
+		cfg:                 cfg,
+		containerRepository: containerRepository,
+		registry:            registry.NewRegistry(containerRepository, serviceBackend.repository, cfg.Hostname),
+		serviceBackend:      serviceBackend,
+		backends:            backends,
+		status:              &syncStatus{},
+		syncRequests:        make(chan chan syncResult),
+	}, nil
+}
+
+// run synchronizes and serves HTTP endpoints until a signal arrives,
+// the in-flight synchronization is canceled before it returns
+func (d *daemon) run(signals <-chan os.Signal) os.Signal {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		d.synchronizeLoop(ctx)
+		close(stopped)
+	}()
+	var server *http.Server
+	if d.cfg.HTTPAddress != "" {
+		server = startHTTPServer(d.cfg.HTTPAddress, d.httpHandler())
+	}
+
+	received := <-signals
+	log.Printf("Received %v, stopping synchronization\n", received)
+	// requested synchronizations are still served by the loop while HTTP server is stopping
+	if server != nil {
+		stopHTTPServer(server)
+	}
+	cancel()
+	<-stopped
+	return received
+}
+
+func (d *daemon) synchronizeLoop(ctx context.Context) {
+	containersIDs := make(chan string)
+	if err := d.containerRepository.Subscribe(containersIDs); err != nil {
+		log.Printf("Error occured during subscribing to docker events: %v\n", err)
+	}
+	defer d.containerRepository.Unsubscribe()
+
+	// the first synchronization runs right away unless reload already did it, it is canceled by signals like others
+	if syncTime, _ := d.status.get(); syncTime.IsZero() {
+		d.synchronize(ctx)
+	}
+	ticker := time.NewTicker(time.Duration(d.cfg.SyncInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.synchronize(ctx)
+		case result := <-d.syncRequests:
+			report, err := d.synchronize(ctx)
+			result <- syncResult{report, err}
+		case containerID := <-containersIDs:
+			syncCtx, cancel := context.WithTimeout(ctx, time.Duration(d.cfg.SyncTimeout))
+			report, err := d.registry.SynchronizeContainer(syncCtx, containerID)
+			cancel()
+			logReport("Synchronization of container "+containerID, report, err)
+		}
+	}
+}
+
+// synchronize runs full synchronization and remembers its result
+func (d *daemon) synchronize(ctx context.Context) (*registry.Report, error) {
+	syncCtx, cancel := context.WithTimeout(ctx, time.Duration(d.cfg.SyncTimeout))
+	defer cancel()
+	report, err := d.registry.Synchronize(syncCtx)
+	d.status.set(err)
+	logReport("Synchronization", report, err)
+	return report, err
+}
+
+func (s *syncStatus) set(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.time = time.Now()
+	s.err = err
+}
+
+// get returns time and error of the last synchronization, time is zero before the first one
+func (s *syncStatus) get() (time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.time, s.err
+}
+
+// shutdown deregisters services managed by pencil when cleanup on exit is enabled
+func (d *daemon) shutdown() {
+	defer d.close()
+	if !d.cfg.CleanupOnExit {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.SyncTimeout))
+	defer cancel()
+	report, err := d.registry.DeregisterAll(ctx)
+	logReport("Deregistration of services", report, err)
+}
+
+// close releases backend clients, services stay registered
+func (d *daemon) close() {
+	if d.serviceBackend != nil {
+		d.serviceBackend.close()
+	}
+}
+
+func logReport(operation string, report *registry.Report, err error) {
+	if err != nil {
+		log.Printf("Error occured during %s: %v\n", strings.ToLower(operation), err)
+	}
+	if report.Changed() {
+		log.Printf("%s: %v\n", operation, report)
+	}
+}
@@ -0,0 +1,83 @@
+package docker
+
+import (
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// containersCache keeps inspected containers until docker reports they changed,
+// so periodic synchronization inspects only new or changed containers
+type containersCache struct {
+	mutex      sync.Mutex
+	containers map[string]cachedContainer
+}
+
+// cachedContainer remembers key of the listed container it was inspected for
+type cachedContainer struct {
+	key     string
+	details *docker.Container
+}
+
+func newContainersCache() *containersCache {
+	return &containersCache{containers: map[string]cachedContainer{}}
+}
+
+// get returns inspected container only when its listed key did not change since inspection
+func (c *containersCache) get(containerID string, key string) (*docker.Container, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached, ok := c.containers[containerID]
+	if !ok || cached.key != key {
+		return nil, false
+	}
+	return cached.details, true
+}
+
+func (c *containersCache) put(containerID string, key string, details *docker.Container) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.containers[containerID] = cachedContainer{key, details}
+}
+
+func (c *containersCache) invalidate(containerID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.containers, containerID)
+}
+
+// retain drops containers which are not listed anymore
+func (c *containersCache) retain(containersIDs map[string]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for containerID := range c.containers {
+		if !containersIDs[containerID] {
+			delete(c.containers, containerID)
+		}
+	}
+}
+
+// clear drops all containers, e.g. when docker events were possibly missed
+func (c *containersCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.containers = map[string]cachedContainer{}
+}
+
+// cacheKey describes listed container with details which change when it is restarted,
+// so stale addresses and published ports are not served although restart events were missed
+func cacheKey(container docker.APIContainers) string {
+	ports := []string{}
+	for _, port := range container.Ports {
+		ports = append(ports, fmt.Sprintf("%s:%d->%d/%s", port.IP, port.PublicPort, port.PrivatePort, port.Type))
+	}
+	sort.Strings(ports)
+	networks := []string{}
+	for name, network := range container.Networks.Networks {
+		networks = append(networks, name+"="+network.IPAddress)
+	}
+	sort.Strings(networks)
+	return fmt.Sprintf("%s|%d|%s|%s", container.State, container.Created, strings.Join(ports, ","), strings.Join(networks, ","))
+}
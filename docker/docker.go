@@ -1,72 +1,380 @@
 package docker
 
 import (
+	"context"
 	"github.com/alaa/pencil-go/registry"
 	docker "github.com/fsouza/go-dockerclient"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 )
 
+// DefaultInspectWorkers limits concurrent container inspections when Options.InspectWorkers is not set
+const DefaultInspectWorkers = 8
+
+// eventsBuffer is capacity of the events listener, docker client drops events which do not fit into it
+const eventsBuffer = 64
+
+var (
+	initialResubscribeDelay = time.Second
+	maxResubscribeDelay     = 30 * time.Second
+)
+
+// containerEvents lists docker events which change the set of services exposed by container
+var containerEvents = map[string]bool{
+	"start":         true,
+	"die":           true,
+	"stop":          true,
+	"destroy":       true,
+	"health_status": true,
+}
+
 type dockerClient interface {
 	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
-	InspectContainer(id string) (*docker.Container, error)
+	InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error)
+	InspectImage(name string) (*docker.Image, error)
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	RemoveEventListener(listener chan *docker.APIEvents) error
+}
+
+// AddressMode defines which address and ports of container are registered
+type AddressMode string
+
+const (
+	// ExposedPortsMode registers exposed container ports without address
+	ExposedPortsMode AddressMode = "exposed"
+	// PublishedPortsMode registers host address and ports published by container,
+	// exposed but unpublished ports are skipped
+	PublishedPortsMode AddressMode = "published"
+	// InternalMode registers container IP address with exposed ports,
+	// for containers attached to routed or overlay networks
+	InternalMode AddressMode = "internal"
+)
+
+// Naming defines how service names are built from container image when SRV_NAME variable is not set
+type Naming string
+
+const (
+	// RepositoryNaming names services after image repository, e.g. "app" for "registry:5000/team/app:1.2"
+	RepositoryNaming Naming = "repository"
+	// PathNaming names services after image namespace and repository, e.g. "team/app"
+	PathNaming Naming = "path"
+	// TemplateNaming names services with Options.NameTemplate
+	TemplateNaming Naming = "template"
+)
+
+// Options configures how docker containers are turned into registry.Containers
+type Options struct {
+	// AddressMode can be overridden per container with "address_mode" label
+	AddressMode AddressMode
+	// AdvertiseIP replaces wildcard host address of published ports
+	AdvertiseIP string
+	// Network selects container network used in InternalMode,
+	// default network address is used when empty
+	Network string
+	// Naming selects how services are named, RepositoryNaming is used when empty
+	Naming Naming
+	// NameTemplate builds service names in TemplateNaming, it is executed with container
+	// Image (Registry, Namespace, Repository, Tag, Digest), Name, Port, Env and Labels;
+	// repository name is used when the template fails or returns empty name
+	NameTemplate *template.Template
+	// Hostname is added to metadata of containers
+	Hostname string
+	// InspectWorkers limits number of containers inspected concurrently
+	InspectWorkers int
+	// OptIn registers only containers labeled with pencil.enable=true
+	OptIn bool
+	// Include selects only containers matching any of filters, all containers are selected when empty
+	Include []Filter
+	// Exclude skips containers matching any of filters
+	Exclude []Filter
 }
 
 // ContainerRepository is docker-based implementation of registry.ContainerRepository
 type ContainerRepository struct {
 	dockerClient dockerClient
+	options      Options
+	cache        *containersCache
+	digests      *imageDigests
+	// mutex guards the subscription, its listener is replaced when docker client closes it
+	mutex        sync.Mutex
+	events       chan *docker.APIEvents
+	unsubscribed chan struct{}
 }
 
 // NewContainerRepository creates new instance of ContainerRepository structure
-func NewContainerRepository(dockerClient dockerClient) *ContainerRepository {
-	return &ContainerRepository{dockerClient: dockerClient}
+func NewContainerRepository(dockerClient dockerClient, options Options) *ContainerRepository {
+	return &ContainerRepository{dockerClient: instrumentedClient{dockerClient}, options: options, cache: newContainersCache(), digests: newImageDigests()}
 }
 
-// GetAll returns list of all running docker containers
-func (cr *ContainerRepository) GetAll() ([]registry.Container, error) {
-	containersIDs, err := cr.getContainersIDs()
+// GetAll returns list of all running docker containers,
+// containers removed before they were inspected are skipped
+func (cr *ContainerRepository) GetAll(ctx context.Context) ([]registry.Container, error) {
+	listedContainers, err := cr.dockerClient.ListContainers(docker.ListContainersOptions{Context: ctx})
 	if err != nil {
 		return nil, err
 	}
-	containers, err := cr.getContainers(containersIDs)
+	containers, err := cr.getContainers(ctx, listedContainers)
 	if err != nil {
 		return nil, err
 	}
 	return containers, nil
 }
 
-func (cr *ContainerRepository) getContainersIDs() ([]string, error) {
-	containersIDs := []string{}
-	containers, err := cr.dockerClient.ListContainers(docker.ListContainersOptions{})
+// Get returns list of containers built from single docker container,
+// the list is empty when the container is not running anymore
+func (cr *ContainerRepository) Get(ctx context.Context, containerID string) ([]registry.Container, error) {
+	containerDetails, err := cr.dockerClient.InspectContainerWithContext(containerID, ctx)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return []registry.Container{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	for _, container := range containers {
-		containersIDs = append(containersIDs, container.ID)
+	if !containerDetails.State.Running {
+		return []registry.Container{}, nil
+	}
+	return buildContainers(containerDetails, cr.options, cr.imageDigest(containerDetails)), nil
+}
+
+// Subscribe listens to docker events and sends IDs of affected containers into the given channel,
+// IDs of containers changed while the receiver is busy are sent once it is ready
+func (cr *ContainerRepository) Subscribe(containersIDs chan<- string) error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	events := make(chan *docker.APIEvents, eventsBuffer)
+	if err := cr.dockerClient.AddEventListener(events); err != nil {
+		return err
+	}
+	cr.events = events
+	cr.unsubscribed = make(chan struct{})
+	go cr.forwardContainerEvents(events, containersIDs, cr.unsubscribed)
+	return nil
+}
+
+// Unsubscribe stops sending containers IDs into the channel given to Subscribe, calling it again does nothing.
+// The listener channel is never closed here, docker client closes listeners itself when it stops monitoring events.
+func (cr *ContainerRepository) Unsubscribe() error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if cr.unsubscribed == nil {
+		return nil
+	}
+	close(cr.unsubscribed)
+	events := cr.events
+	cr.events, cr.unsubscribed = nil, nil
+	// listener closed by docker client is already removed
+	if events == nil {
+		return nil
 	}
-	return containersIDs, nil
+	return cr.dockerClient.RemoveEventListener(events)
 }
 
-func (cr *ContainerRepository) getContainers(containersIDs []string) ([]registry.Container, error) {
+// forwardContainerEvents keeps reading the listener while the receiver is busy, IDs waiting for the receiver
+// are coalesced, so repeated events of a container are sent once.
+// It stops when Unsubscribe is called.
+func (cr *ContainerRepository) forwardContainerEvents(events <-chan *docker.APIEvents, containersIDs chan<- string, unsubscribed <-chan struct{}) {
+	pending := []string{}
+	pendingSet := map[string]bool{}
+	for {
+		// sending is disabled with nil channel until there is a pending ID
+		var send chan<- string
+		var next string
+		if len(pending) > 0 {
+			send, next = containersIDs, pending[0]
+		}
+		select {
+		case event, ok := <-events:
+			if !ok {
+				if events = cr.resubscribe(unsubscribed); events == nil {
+					return
+				}
+				continue
+			}
+			if containerID, ok := affectedContainerID(event); ok {
+				cr.cache.invalidate(containerID)
+				if !pendingSet[containerID] {
+					pendingSet[containerID] = true
+					pending = append(pending, containerID)
+				}
+			}
+		case send <- next:
+			delete(pendingSet, next)
+			pending = pending[1:]
+		case <-unsubscribed:
+			return
+		}
+	}
+}
+
+// resubscribe adds new listener with exponentially growing delays after docker client closed the previous one,
+// e.g. when docker daemon restarted. It returns nil when Unsubscribe is called first.
+func (cr *ContainerRepository) resubscribe(unsubscribed <-chan struct{}) chan *docker.APIEvents {
+	cr.mutex.Lock()
+	select {
+	case <-unsubscribed:
+	default:
+		cr.events = nil
+	}
+	cr.mutex.Unlock()
+	// events were possibly missed, so containers are inspected again
+	cr.cache.clear()
+
+	delay := initialResubscribeDelay
+	for {
+		log.Printf("Docker events listener was closed, subscribing again in %v\n", delay)
+		select {
+		case <-unsubscribed:
+			return nil
+		case <-time.After(delay):
+		}
+		events, err := cr.addEventListener(unsubscribed)
+		if err == nil {
+			return events
+		}
+		log.Printf("Error occured during subscribing to docker events: %v\n", err)
+		delay *= 2
+		if delay > maxResubscribeDelay {
+			delay = maxResubscribeDelay
+		}
+	}
+}
+
+// addEventListener replaces the listener of active subscription, it returns nil listener after Unsubscribe
+func (cr *ContainerRepository) addEventListener(unsubscribed <-chan struct{}) (chan *docker.APIEvents, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	select {
+	case <-unsubscribed:
+		return nil, nil
+	default:
+	}
+	events := make(chan *docker.APIEvents, eventsBuffer)
+	if err := cr.dockerClient.AddEventListener(events); err != nil {
+		return nil, err
+	}
+	cr.events = events
+	return events, nil
+}
+
+func affectedContainerID(event *docker.APIEvents) (string, bool) {
+	if event.Type != "" && event.Type != "container" {
+		return "", false
+	}
+	action := event.Action
+	if action == "" {
+		action = event.Status
+	}
+	// health_status events carry the status in action, e.g. "health_status: healthy"
+	action = strings.SplitN(action, ":", 2)[0]
+	if !containerEvents[action] {
+		return "", false
+	}
+	if event.Actor.ID != "" {
+		return event.Actor.ID, true
+	}
+	return event.ID, event.ID != ""
+}
+
+// getContainers inspects listed containers with a bounded number of workers,
+// the containers keep the order of the list
+func (cr *ContainerRepository) getContainers(ctx context.Context, listedContainers []docker.APIContainers) ([]registry.Container, error) {
+	details := make([]*docker.Container, len(listedContainers))
+	errs := make([]error, len(listedContainers))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < cr.inspectWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				details[index], errs[index] = cr.inspect(ctx, listedContainers[index])
+			}
+		}()
+	}
+	for index := range listedContainers {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	listedIDs := map[string]bool{}
 	containers := []registry.Container{}
-	for _, containerID := range containersIDs {
-		containerDetails, err := cr.dockerClient.InspectContainer(containerID)
-		if err != nil {
-			return nil, err
+	for index, listedContainer := range listedContainers {
+		if _, ok := errs[index].(*docker.NoSuchContainer); ok {
+			continue
 		}
-		containers = append(containers, buildContainers(containerDetails)...)
+		if errs[index] != nil {
+			return nil, errs[index]
+		}
+		listedIDs[listedContainer.ID] = true
+		containers = append(containers, buildContainers(details[index], cr.options, cr.imageDigest(details[index]))...)
 	}
+	cr.cache.retain(listedIDs)
 	return containers, nil
 }
 
-func buildContainers(container *docker.Container) []registry.Container {
+// inspect returns cached details unless the container changed state, ports or addresses since it was inspected
+func (cr *ContainerRepository) inspect(ctx context.Context, listedContainer docker.APIContainers) (*docker.Container, error) {
+	key := cacheKey(listedContainer)
+	if details, ok := cr.cache.get(listedContainer.ID, key); ok {
+		return details, nil
+	}
+	details, err := cr.dockerClient.InspectContainerWithContext(listedContainer.ID, ctx)
+	if err != nil {
+		return nil, err
+	}
+	cr.cache.put(listedContainer.ID, key, details)
+	return details, nil
+}
+
+// imageDigest returns digest of the image container runs, e.g. "sha256:9b2e...", images are inspected once.
+// Digest is empty for images which were never pushed nor pulled by digest, or when the image cannot be inspected.
+func (cr *ContainerRepository) imageDigest(container *docker.Container) string {
+	if digest := parseImageReference(container.Config.Image).Digest; digest != "" || container.Image == "" {
+		return digest
+	}
+	if digest, ok := cr.digests.get(container.Image); ok {
+		return digest
+	}
+	image, err := cr.dockerClient.InspectImage(container.Image)
+	if err != nil {
+		log.Printf("Error occured during inspecting image %s: %v\n", container.Image, err)
+		return ""
+	}
+	digest := repoDigest(image.RepoDigests, parseImageReference(container.Config.Image))
+	cr.digests.put(container.Image, digest)
+	return digest
+}
+
+func (cr *ContainerRepository) inspectWorkers() int {
+	if cr.options.InspectWorkers > 0 {
+		return cr.options.InspectWorkers
+	}
+	return DefaultInspectWorkers
+}
+
+func buildContainers(container *docker.Container, options Options, imageDigest string) []registry.Container {
 	containerWrapper := dockerContainerWrapper{*container}
 	containers := []registry.Container{}
+	if !containerWrapper.isSelected(options) {
+		return containers
+	}
 
-	for _, port := range containerWrapper.getExposedTCPPorts() {
+	for _, endpoint := range containerWrapper.getEndpoints(options) {
+		if containerWrapper.isPortIgnored(endpoint.ExposedPort) {
+			continue
+		}
 		container := registry.Container{
-			ID:   containerWrapper.ID,
-			Name: containerWrapper.getName(),
-			Tags: containerWrapper.getTags(),
-			Port: port,
+			ID:      containerWrapper.ID,
+			Name:    containerWrapper.getPortName(endpoint.ExposedPort, options),
+			Tags:    containerWrapper.getPortTags(endpoint.ExposedPort),
+			Meta:    containerWrapper.getMeta(options.Hostname, imageDigest),
+			Address: endpoint.Address,
+			Port:    endpoint.Port,
+			Check:   containerWrapper.getCheck(endpoint.ExposedPort),
 		}
 		containers = append(containers, container)
 	}
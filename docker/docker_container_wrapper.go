@@ -1,16 +1,48 @@
 package docker
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/alaa/pencil-go/registry"
 	docker "github.com/fsouza/go-dockerclient"
+	"log"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 )
 
+// metaLabelPrefix marks labels copied into service metadata, e.g. "pencil.meta.version=1.2"
+const metaLabelPrefix = "pencil.meta."
+
+// Limits of service metadata accepted by consul agent, which rejects the whole registration otherwise.
+// Consul allows 64 pairs, the rest is left for the check definition kept in metadata by consul backend.
+const (
+	maxMetaPairs       = 60
+	maxMetaKeyLength   = 128
+	maxMetaValueLength = 512
+	reservedMetaPrefix = "consul-"
+	// checkMetaPrefix is reserved by consul backend for metadata keeping check definition
+	checkMetaPrefix = "pencil_check"
+)
+
+var invalidMetaKeyCharacters = regexp.MustCompile("[^A-Za-z0-9_-]")
+
 type dockerContainerWrapper struct {
 	docker.Container
 }
 
+// endpoint is address and port under which exposed container port is reachable
+type endpoint struct {
+	ExposedPort int
+	Address     string
+	Port        int
+}
+
+// wildcardIPs are host addresses meaning that port is published on all interfaces
+var wildcardIPs = map[string]bool{"": true, "0.0.0.0": true, "::": true}
+
 func (c *dockerContainerWrapper) getExposedTCPPorts() (ports []int) {
 	for port := range c.NetworkSettings.Ports {
 		if port.Proto() == "tcp" {
@@ -22,6 +54,82 @@ func (c *dockerContainerWrapper) getExposedTCPPorts() (ports []int) {
 	return
 }
 
+func (c *dockerContainerWrapper) getEndpoints(options Options) []endpoint {
+	switch c.getAddressMode(options.AddressMode) {
+	case PublishedPortsMode:
+		return c.getPublishedEndpoints(options.AdvertiseIP)
+	case InternalMode:
+		return c.getInternalEndpoints(options.Network)
+	}
+	return c.getExposedEndpoints("")
+}
+
+func (c *dockerContainerWrapper) getAddressMode(defaultMode AddressMode) AddressMode {
+	if mode, exist := c.Config.Labels["address_mode"]; exist {
+		return AddressMode(mode)
+	}
+	return defaultMode
+}
+
+func (c *dockerContainerWrapper) getExposedEndpoints(address string) []endpoint {
+	endpoints := []endpoint{}
+	for _, port := range c.getExposedTCPPorts() {
+		endpoints = append(endpoints, endpoint{ExposedPort: port, Address: address, Port: port})
+	}
+	return endpoints
+}
+
+// getInternalEndpoints returns no endpoints when container has no IP address
+func (c *dockerContainerWrapper) getInternalEndpoints(network string) []endpoint {
+	address := c.getIPAddress(network)
+	if address == "" {
+		return []endpoint{}
+	}
+	return c.getExposedEndpoints(address)
+}
+
+// getIPAddress falls back to the first of container networks when default bridge address is missing
+func (c *dockerContainerWrapper) getIPAddress(network string) string {
+	if network != "" {
+		return c.NetworkSettings.Networks[network].IPAddress
+	}
+	if c.NetworkSettings.IPAddress != "" {
+		return c.NetworkSettings.IPAddress
+	}
+	networks := []string{}
+	for name := range c.NetworkSettings.Networks {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+	for _, name := range networks {
+		if address := c.NetworkSettings.Networks[name].IPAddress; address != "" {
+			return address
+		}
+	}
+	return ""
+}
+
+func (c *dockerContainerWrapper) getPublishedEndpoints(advertiseIP string) []endpoint {
+	endpoints := []endpoint{}
+	for _, exposedPort := range c.getExposedTCPPorts() {
+		published := map[int]bool{}
+		bindings := c.NetworkSettings.Ports[docker.Port(fmt.Sprintf("%d/tcp", exposedPort))]
+		for _, binding := range bindings {
+			hostPort, err := strconv.Atoi(binding.HostPort)
+			if err != nil || published[hostPort] {
+				continue
+			}
+			published[hostPort] = true
+			address := binding.HostIP
+			if wildcardIPs[address] {
+				address = advertiseIP
+			}
+			endpoints = append(endpoints, endpoint{ExposedPort: exposedPort, Address: address, Port: hostPort})
+		}
+	}
+	return endpoints
+}
+
 func (c *dockerContainerWrapper) getTags() []string {
 	tags, exist := c.Config.Labels["tags"]
 	if !exist {
@@ -30,26 +138,152 @@ func (c *dockerContainerWrapper) getTags() []string {
 	return strings.Split(tags, ",")
 }
 
+// getPortName reads "service_<port>_name" label, name of container is used when it is missing
+func (c *dockerContainerWrapper) getPortName(port int, options Options) string {
+	if name, exist := c.Config.Labels[fmt.Sprintf("service_%d_name", port)]; exist {
+		return name
+	}
+	return c.getName(port, options)
+}
+
+// getPortTags reads "service_<port>_tags" label, tags of container are used when it is missing
+func (c *dockerContainerWrapper) getPortTags(port int) []string {
+	if tags, exist := c.Config.Labels[fmt.Sprintf("service_%d_tags", port)]; exist {
+		return strings.Split(tags, ",")
+	}
+	return c.getTags()
+}
+
+// isPortIgnored tells whether port is skipped with "service_<port>_ignore=true" label
+func (c *dockerContainerWrapper) isPortIgnored(port int) bool {
+	return c.hasTrueLabel(fmt.Sprintf("service_%d_ignore", port))
+}
+
+// getMeta returns metadata describing container and host, "pencil.meta.<key>" labels add or override metadata.
+// Characters of keys which are not allowed by consul are replaced with "_", e.g. "app.version" becomes "app_version",
+// labels which still exceed consul limits are skipped.
+func (c *dockerContainerWrapper) getMeta(hostname string, imageDigest string) map[string]string {
+	meta := map[string]string{}
+	automatic := map[string]string{
+		"container_id":   c.ID,
+		"container_name": strings.TrimPrefix(c.Name, "/"),
+		"image":          c.Config.Image,
+		"image_id":       c.Image,
+		"image_digest":   imageDigest,
+		"host":           hostname,
+	}
+	for key, value := range automatic {
+		if value != "" {
+			meta[key] = value
+		}
+	}
+	// labels are sorted, so the same labels are skipped every time the limit of pairs is reached
+	labels := []string{}
+	for label := range c.Config.Labels {
+		if strings.HasPrefix(label, metaLabelPrefix) {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		key := invalidMetaKeyCharacters.ReplaceAllString(strings.TrimPrefix(label, metaLabelPrefix), "_")
+		value := c.Config.Labels[label]
+		if err := validateMeta(meta, key, value); err != nil {
+			log.Printf("Label %s of container %s is skipped: %v\n", label, c.ID, err)
+			continue
+		}
+		meta[key] = value
+	}
+	return meta
+}
+
+func validateMeta(meta map[string]string, key string, value string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("metadata key is empty")
+	case len(key) > maxMetaKeyLength:
+		return fmt.Errorf("metadata key is longer than %d characters", maxMetaKeyLength)
+	case strings.HasPrefix(key, reservedMetaPrefix):
+		return fmt.Errorf("metadata key prefix %q is reserved", reservedMetaPrefix)
+	case strings.HasPrefix(key, checkMetaPrefix):
+		return fmt.Errorf("metadata key prefix %q is reserved for check definition", checkMetaPrefix)
+	case len(value) > maxMetaValueLength:
+		return fmt.Errorf("metadata value is longer than %d characters", maxMetaValueLength)
+	}
+	if _, exist := meta[key]; !exist && len(meta) >= maxMetaPairs {
+		return fmt.Errorf("there are more than %d metadata pairs", maxMetaPairs)
+	}
+	return nil
+}
+
+// getCheck reads health check from "check_<kind>" labels,
+// "check_<port>_<kind>" labels override them for given port
+func (c *dockerContainerWrapper) getCheck(port int) registry.ServiceCheck {
+	return registry.ServiceCheck{
+		Script:   c.getCheckLabel(port, "script"),
+		HTTP:     c.getCheckLabel(port, "http"),
+		TCP:      c.getCheckLabel(port, "tcp"),
+		Interval: c.getCheckLabel(port, "interval"),
+		Timeout:  c.getCheckLabel(port, "timeout"),
+		TTL:      c.getCheckLabel(port, "ttl"),
+	}
+}
+
+func (c *dockerContainerWrapper) getCheckLabel(port int, kind string) string {
+	if value, exist := c.Config.Labels[fmt.Sprintf("check_%d_%s", port, kind)]; exist {
+		return value
+	}
+	return c.Config.Labels["check_"+kind]
+}
+
+// getEnv skips variables without value, e.g. "FOO" which passes variable from docker client environment
 func (c *dockerContainerWrapper) getEnv() map[string]string {
 	envMap := make(map[string]string)
 	for _, value := range c.Config.Env {
-		envParts := strings.Split(value, "=")
-		envMap[envParts[0]] = envParts[1]
+		if envParts := strings.SplitN(value, "=", 2); len(envParts) == 2 {
+			envMap[envParts[0]] = envParts[1]
+		}
 	}
 	return envMap
 }
 
-func (c *dockerContainerWrapper) getName() string {
+// getName returns SRV_NAME variable or name built from image according to naming strategy
+func (c *dockerContainerWrapper) getName(port int, options Options) string {
 	if name, exist := c.getEnv()["SRV_NAME"]; exist {
 		return name
 	}
-	return c.getImage()
+	image := parseImageReference(c.Config.Image)
+	switch options.Naming {
+	case PathNaming:
+		return image.Path()
+	case TemplateNaming:
+		if name, err := c.executeNameTemplate(options.NameTemplate, image, port); err == nil && name != "" {
+			return name
+		}
+	}
+	return image.Repository
+}
+
+// nameTemplateData is available in name templates, e.g. "{{.Image.Namespace}}-{{.Image.Repository}}"
+type nameTemplateData struct {
+	Image  imageReference
+	Name   string
+	Port   int
+	Env    map[string]string
+	Labels map[string]string
 }
 
-func (c *dockerContainerWrapper) getImage() string {
-	imageParts := strings.Split(c.Config.Image, "/")
-	if len(imageParts) > 1 {
-		return imageParts[1]
+func (c *dockerContainerWrapper) executeNameTemplate(nameTemplate *template.Template, image imageReference, port int) (string, error) {
+	if nameTemplate == nil {
+		return "", fmt.Errorf("name template is missing")
 	}
-	return imageParts[0]
+	name := bytes.Buffer{}
+	err := nameTemplate.Execute(&name, nameTemplateData{
+		Image:  image,
+		Name:   strings.TrimPrefix(c.Name, "/"),
+		Port:   port,
+		Env:    c.getEnv(),
+		Labels: c.Config.Labels,
+	})
+	return strings.TrimSpace(name.String()), err
 }
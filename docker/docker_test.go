@@ -1,13 +1,19 @@
 package docker
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/alaa/pencil-go/registry"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
 )
 
 var (
@@ -54,6 +60,9 @@ var (
 		},
 	}
 
+	containerAMeta = map[string]string{"container_id": containerADetails.ID, "image": "brainly/eve-landing-pages"}
+	containerBMeta = map[string]string{"container_id": containerBDetails.ID, "image": "brainly/eve-who-is-your-daddy"}
+
 	containerCDetails = docker.Container{
 		Config: &docker.Config{Labels: map[string]string{"tags": "tag1"}},
 	}
@@ -73,20 +82,56 @@ func TestProperlyWrapContainers(t *testing.T) {
 
 func testWrapperForContainer(t *testing.T, container docker.Container, expectedName string, expectedPorts []int, expectedTags []string) {
 	dockerContainerWrapper := dockerContainerWrapper{container}
-	assert.Equal(t, expectedName, dockerContainerWrapper.getName())
+	assert.Equal(t, expectedName, dockerContainerWrapper.getName(0, Options{}))
 	assert.Equal(t, expectedPorts, dockerContainerWrapper.getExposedTCPPorts())
 	assert.Equal(t, expectedTags, dockerContainerWrapper.getTags())
 }
 
+func TestEnvironmentWithEqualSignsAndWithoutValues(t *testing.T) {
+	wrapper := dockerContainerWrapper{docker.Container{Config: &docker.Config{
+		Env: []string{"OPTS=a=b", "FOO", "EMPTY=", "SRV_NAME=api"},
+	}}}
+
+	assert.Equal(t, map[string]string{"OPTS": "a=b", "EMPTY": "", "SRV_NAME": "api"}, wrapper.getEnv())
+	assert.Equal(t, "api", wrapper.getName(0, Options{}))
+}
+
+func TestParseImageReference(t *testing.T) {
+	assert.Equal(t, imageReference{Repository: "redis"}, parseImageReference("redis"))
+	assert.Equal(t, imageReference{Repository: "nginx", Tag: "1.25"}, parseImageReference("nginx:1.25"))
+	assert.Equal(t, imageReference{Namespace: "brainly", Repository: "eve"}, parseImageReference("brainly/eve"))
+	assert.Equal(t, imageReference{Registry: "localhost", Namespace: "team", Repository: "app"}, parseImageReference("localhost/team/app"))
+	assert.Equal(t,
+		imageReference{Registry: "registry.example.com:5000", Namespace: "team/backend", Repository: "app", Tag: "1.2", Digest: "sha256:9b2e"},
+		parseImageReference("registry.example.com:5000/team/backend/app:1.2@sha256:9b2e"),
+	)
+	assert.Equal(t, imageReference{Registry: "localhost:5000", Repository: "app"}, parseImageReference("localhost:5000/app"))
+}
+
+func TestServiceNamesBuiltFromImage(t *testing.T) {
+	wrapper := dockerContainerWrapper{docker.Container{
+		Name:   "/app-1",
+		Config: &docker.Config{Image: "registry.example.com:5000/team/app:1.2", Labels: map[string]string{"env": "prod"}},
+	}}
+	nameTemplate := template.Must(template.New("name").Parse(`{{.Image.Namespace}}-{{.Image.Repository}}-{{index .Labels "env"}}-{{.Port}}`))
+	failingTemplate := template.Must(template.New("name").Parse(`{{.Missing}}`))
+
+	assert.Equal(t, "app", wrapper.getName(8080, Options{}))
+	assert.Equal(t, "app", wrapper.getName(8080, Options{Naming: RepositoryNaming}))
+	assert.Equal(t, "team/app", wrapper.getName(8080, Options{Naming: PathNaming}))
+	assert.Equal(t, "team-app-prod-8080", wrapper.getName(8080, Options{Naming: TemplateNaming, NameTemplate: nameTemplate}))
+	assert.Equal(t, "app", wrapper.getName(8080, Options{Naming: TemplateNaming, NameTemplate: failingTemplate}))
+}
+
 func TestGetAllWhenNoContainersAreRunning(t *testing.T) {
 	client := mockDockerClient{}
-	containerRepository := NewContainerRepository(&client)
+	containerRepository := NewContainerRepository(&client, Options{})
 
-	client.On("ListContainers", docker.ListContainersOptions{}).Return([]docker.APIContainers{}, nil)
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{}, nil)
 
 	expectedContainers := []registry.Container{}
 
-	containers, err := containerRepository.GetAll()
+	containers, err := containerRepository.GetAll(context.Background())
 
 	assert.Nil(t, err)
 	assert.Equal(t, expectedContainers, containers)
@@ -94,11 +139,11 @@ func TestGetAllWhenNoContainersAreRunning(t *testing.T) {
 
 func TestGetRunningContainersWithTwoContainers(t *testing.T) {
 	client := mockDockerClient{}
-	repository := NewContainerRepository(&client)
+	repository := NewContainerRepository(&client, Options{})
 
-	client.On("ListContainers", docker.ListContainersOptions{}).Return([]docker.APIContainers{containerA, containerB}, nil)
-	client.On("InspectContainer", "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9").Return(&containerADetails, nil)
-	client.On("InspectContainer", "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db").Return(&containerBDetails, nil)
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{containerA, containerB}, nil)
+	client.On("InspectContainerWithContext", "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9").Return(&containerADetails, nil)
+	client.On("InspectContainerWithContext", "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db").Return(&containerBDetails, nil)
 
 	expectedContainers := []registry.Container{
 		registry.Container{
@@ -106,22 +151,25 @@ func TestGetRunningContainersWithTwoContainers(t *testing.T) {
 			Name: "eve-landing-pages",
 			Port: 22,
 			Tags: []string{},
+			Meta: containerAMeta,
 		},
 		registry.Container{
 			ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
 			Name: "eve-landing-pages",
 			Port: 8000,
 			Tags: []string{},
+			Meta: containerAMeta,
 		},
 		registry.Container{
 			ID:   "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db",
 			Name: "microservice2",
 			Port: 9000,
 			Tags: []string{"tag1", "tag2"},
+			Meta: containerBMeta,
 		},
 	}
 
-	containers, _ := repository.GetAll()
+	containers, _ := repository.GetAll(context.Background())
 	sort.Sort(byID{containers})
 
 	assert.Equal(t, expectedContainers, containers)
@@ -132,31 +180,627 @@ func TestContainerWithOneTag(t *testing.T) {
 	assert.Equal(t, []string{"tag1"}, wrapper.getTags())
 }
 
+func TestContainerHealthCheckWithPortOverride(t *testing.T) {
+	wrapper := dockerContainerWrapper{docker.Container{
+		Config: &docker.Config{Labels: map[string]string{
+			"check_http":      "/health",
+			"check_interval":  "5s",
+			"check_9100_http": "/metrics",
+			"check_22_tcp":    "true",
+			"check_22_http":   "",
+		}},
+	}}
+
+	assert.Equal(t, registry.ServiceCheck{HTTP: "/health", Interval: "5s"}, wrapper.getCheck(8000))
+	assert.Equal(t, registry.ServiceCheck{HTTP: "/metrics", Interval: "5s"}, wrapper.getCheck(9100))
+	assert.Equal(t, registry.ServiceCheck{TCP: "true", Interval: "5s"}, wrapper.getCheck(22))
+}
+
+func TestServicesNamedAndTaggedPerPort(t *testing.T) {
+	container := docker.Container{
+		ID: "container1",
+		Config: &docker.Config{
+			Image: "brainly/backend",
+			Labels: map[string]string{
+				"tags":                "web",
+				"service_8080_name":   "api",
+				"service_9100_name":   "api-metrics",
+				"service_9100_tags":   "metrics,prometheus",
+				"service_22_ignore":   "true",
+				"service_8081_ignore": "false",
+			},
+		},
+		NetworkSettings: &docker.NetworkSettings{
+			Ports: map[docker.Port][]docker.PortBinding{
+				"22/tcp":   []docker.PortBinding{},
+				"8080/tcp": []docker.PortBinding{},
+				"8081/tcp": []docker.PortBinding{},
+				"9100/tcp": []docker.PortBinding{},
+			},
+		},
+	}
+
+	meta := map[string]string{"container_id": "container1", "image": "brainly/backend"}
+	assert.Equal(t, []registry.Container{
+		registry.Container{ID: "container1", Name: "api", Port: 8080, Tags: []string{"web"}, Meta: meta},
+		registry.Container{ID: "container1", Name: "backend", Port: 8081, Tags: []string{"web"}, Meta: meta},
+		registry.Container{ID: "container1", Name: "api-metrics", Port: 9100, Tags: []string{"metrics", "prometheus"}, Meta: meta},
+	}, buildContainers(&container, Options{}, ""))
+}
+
+func TestMetadataFromContainerAndLabels(t *testing.T) {
+	wrapper := dockerContainerWrapper{docker.Container{
+		ID:    "container1",
+		Name:  "/web-1",
+		Image: "sha256:4f0a1c",
+		Config: &docker.Config{
+			Image:  "brainly/web@sha256:9b2e",
+			Labels: map[string]string{"pencil.meta.version": "1.2", "pencil.meta.host": "edge", "tags": "web"},
+		},
+	}}
+
+	assert.Equal(t, map[string]string{
+		"container_id":   "container1",
+		"container_name": "web-1",
+		"image":          "brainly/web@sha256:9b2e",
+		"image_id":       "sha256:4f0a1c",
+		"image_digest":   "sha256:9b2e",
+		"host":           "edge",
+		"version":        "1.2",
+	}, wrapper.getMeta("node1", "sha256:9b2e"))
+}
+
+func TestMetadataLabelsAreAdjustedToConsulLimits(t *testing.T) {
+	labels := map[string]string{
+		"pencil.meta.app.version":                 "1.2",
+		"pencil.meta.consul-version":              "1.0",
+		"pencil.meta." + strings.Repeat("k", 129): "long key",
+		"pencil.meta.long_value":                  strings.Repeat("v", 513),
+	}
+	for i := 0; i < maxMetaPairs; i++ {
+		labels[fmt.Sprintf("pencil.meta.label%02d", i)] = "value"
+	}
+	wrapper := dockerContainerWrapper{docker.Container{ID: "container1", Config: &docker.Config{Labels: labels}}}
+
+	meta := wrapper.getMeta("", "")
+
+	assert.Len(t, meta, maxMetaPairs)
+	assert.Equal(t, "1.2", meta["app_version"])
+	assert.Equal(t, "container1", meta["container_id"])
+	assert.NotContains(t, meta, "consul-version")
+	assert.NotContains(t, meta, "long_value")
+	assert.Equal(t, "value", meta["label57"])
+	assert.NotContains(t, meta, "label58")
+}
+
+func TestMetadataLabelsCannotOverrideCheckDefinition(t *testing.T) {
+	wrapper := dockerContainerWrapper{docker.Container{ID: "container1", Config: &docker.Config{Labels: map[string]string{
+		"pencil.meta.pencil_check":   `{"HTTP":"http://evil/"}`,
+		"pencil.meta.pencil_check_1": "}",
+		"pencil.meta.team":           "web",
+	}}}}
+
+	meta := wrapper.getMeta("", "")
+
+	assert.Equal(t, map[string]string{"container_id": "container1", "team": "web"}, meta)
+}
+
+func TestPublishedPortsModeRegistersHostAddressAndPort(t *testing.T) {
+	container := docker.Container{
+		ID:     "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+		Config: &docker.Config{Image: "nginx", Labels: map[string]string{"check_80_http": "/health"}},
+		NetworkSettings: &docker.NetworkSettings{
+			Ports: map[docker.Port][]docker.PortBinding{
+				"80/tcp": []docker.PortBinding{
+					docker.PortBinding{HostIP: "0.0.0.0", HostPort: "8080"},
+					docker.PortBinding{HostIP: "::", HostPort: "8080"},
+				},
+				"443/tcp":  []docker.PortBinding{docker.PortBinding{HostIP: "10.0.0.5", HostPort: "8443"}},
+				"9000/tcp": []docker.PortBinding{},
+				"53/udp":   []docker.PortBinding{docker.PortBinding{HostIP: "0.0.0.0", HostPort: "53"}},
+			},
+		},
+	}
+
+	nginxMeta := map[string]string{"container_id": container.ID, "image": "nginx"}
+	expectedContainers := []registry.Container{
+		registry.Container{
+			ID:      "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+			Name:    "nginx",
+			Address: "192.168.1.10",
+			Port:    8080,
+			Tags:    []string{},
+			Meta:    nginxMeta,
+			Check:   registry.ServiceCheck{HTTP: "/health"},
+		},
+		registry.Container{
+			ID:      "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+			Name:    "nginx",
+			Address: "10.0.0.5",
+			Port:    8443,
+			Tags:    []string{},
+			Meta:    nginxMeta,
+		},
+	}
+
+	containers := buildContainers(&container, Options{AddressMode: PublishedPortsMode, AdvertiseIP: "192.168.1.10"}, "")
+	assert.Equal(t, expectedContainers, containers)
+}
+
+func TestInternalModeRegistersContainerIPAddress(t *testing.T) {
+	wrapper := dockerContainerWrapper{docker.Container{
+		Config: &docker.Config{Labels: map[string]string{}},
+		NetworkSettings: &docker.NetworkSettings{
+			IPAddress: "172.17.0.2",
+			Networks: map[string]docker.ContainerNetwork{
+				"bridge":  docker.ContainerNetwork{IPAddress: "172.17.0.2"},
+				"overlay": docker.ContainerNetwork{IPAddress: "10.10.0.7"},
+			},
+			Ports: map[docker.Port][]docker.PortBinding{
+				"8000/tcp": []docker.PortBinding{docker.PortBinding{HostIP: "0.0.0.0", HostPort: "32768"}},
+			},
+		},
+	}}
+
+	assert.Equal(t,
+		[]endpoint{endpoint{ExposedPort: 8000, Address: "172.17.0.2", Port: 8000}},
+		wrapper.getEndpoints(Options{AddressMode: InternalMode}),
+	)
+	assert.Equal(t,
+		[]endpoint{endpoint{ExposedPort: 8000, Address: "10.10.0.7", Port: 8000}},
+		wrapper.getEndpoints(Options{AddressMode: InternalMode, Network: "overlay"}),
+	)
+	assert.Equal(t,
+		[]endpoint{},
+		wrapper.getEndpoints(Options{AddressMode: InternalMode, Network: "missing"}),
+	)
+}
+
+func TestAddressModeOverriddenByLabel(t *testing.T) {
+	wrapper := dockerContainerWrapper{docker.Container{
+		Config: &docker.Config{Labels: map[string]string{"address_mode": "internal"}},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]docker.ContainerNetwork{
+				"routed": docker.ContainerNetwork{IPAddress: "10.20.0.3"},
+			},
+			Ports: map[docker.Port][]docker.PortBinding{
+				"8000/tcp": []docker.PortBinding{docker.PortBinding{HostIP: "0.0.0.0", HostPort: "32768"}},
+			},
+		},
+	}}
+
+	assert.Equal(t,
+		[]endpoint{endpoint{ExposedPort: 8000, Address: "10.20.0.3", Port: 8000}},
+		wrapper.getEndpoints(Options{AddressMode: PublishedPortsMode, AdvertiseIP: "192.168.1.10"}),
+	)
+}
+
+func TestContainersSelectedByLabels(t *testing.T) {
+	ignored := dockerContainerWrapper{docker.Container{Config: &docker.Config{Labels: map[string]string{"pencil.ignore": "true"}}}}
+	enabled := dockerContainerWrapper{docker.Container{Config: &docker.Config{Labels: map[string]string{"pencil.enable": "true"}}}}
+	unlabeled := dockerContainerWrapper{docker.Container{Config: &docker.Config{}}}
+
+	assert.False(t, ignored.isSelected(Options{}))
+	assert.True(t, enabled.isSelected(Options{}))
+	assert.True(t, unlabeled.isSelected(Options{}))
+
+	assert.True(t, enabled.isSelected(Options{OptIn: true}))
+	assert.False(t, unlabeled.isSelected(Options{OptIn: true}))
+}
+
+func TestContainersSelectedByFilters(t *testing.T) {
+	container := dockerContainerWrapper{docker.Container{
+		Name:   "/web-1",
+		Config: &docker.Config{Image: "brainly/eve-landing-pages:1.2", Labels: map[string]string{"role": "frontend"}},
+	}}
+	filters := func(filters ...string) []Filter {
+		parsed, err := ParseFilters(filters)
+		assert.Nil(t, err)
+		return parsed
+	}
+
+	assert.True(t, container.isSelected(Options{Include: filters("image=brainly/*")}))
+	assert.True(t, container.isSelected(Options{Include: filters("image=redis*", "name~=^web-")}))
+	assert.False(t, container.isSelected(Options{Include: filters("image=eve-*")}))
+	assert.False(t, container.isSelected(Options{Include: filters("label:owner=*")}))
+	assert.False(t, container.isSelected(Options{Exclude: filters("label:role~=^(frontend|db)$")}))
+	assert.False(t, container.isSelected(Options{Include: filters("name=web-?"), Exclude: filters("image=*:1.2")}))
+	assert.True(t, container.isSelected(Options{Exclude: filters("name=web")}))
+}
+
+func TestParseFilterFailsOnInvalidFilter(t *testing.T) {
+	_, err := ParseFilter("redis")
+	assert.EqualError(t, err, `invalid filter "redis", expected <field>=<pattern>`)
+
+	_, err = ParseFilter("tag=latest")
+	assert.EqualError(t, err, `unknown field "tag" of filter "tag=latest"`)
+
+	_, err = ParseFilter("label:=x")
+	assert.EqualError(t, err, `invalid filter "label:=x", label name is missing`)
+
+	_, err = ParseFilter("name~=(")
+	assert.Error(t, err)
+}
+
+func TestGetAllSkipsNotSelectedContainers(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{OptIn: true})
+	enabledContainerB := containerBDetails
+	enabledContainerB.Config = &docker.Config{
+		Env:    containerBConfig.Env,
+		Image:  containerBConfig.Image,
+		Labels: map[string]string{"pencil.enable": "true"},
+	}
+
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{containerA, containerB}, nil)
+	client.On("InspectContainerWithContext", "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9").Return(&containerADetails, nil)
+	client.On("InspectContainerWithContext", "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db").Return(&enabledContainerB, nil)
+
+	containers, err := repository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Len(t, containers, 1)
+	assert.Equal(t, "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db", containers[0].ID)
+}
+
 func TestGetAllWhenListContainersFails(t *testing.T) {
 	client := mockDockerClient{}
-	containerRepository := NewContainerRepository(&client)
+	containerRepository := NewContainerRepository(&client, Options{})
 	expectedError := errors.New("foo")
 
-	client.On("ListContainers", docker.ListContainersOptions{}).Return([]docker.APIContainers{}, expectedError)
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{}, expectedError)
 
-	_, err := containerRepository.GetAll()
+	_, err := containerRepository.GetAll(context.Background())
 	assert.Equal(t, expectedError, err)
 }
 
 func TestGetAllWhenInspectContainerFails(t *testing.T) {
 	client := mockDockerClient{}
-	containerRepository := NewContainerRepository(&client)
+	containerRepository := NewContainerRepository(&client, Options{})
 	expectedError := errors.New("bar")
 
-	client.On("ListContainers", docker.ListContainersOptions{}).Return([]docker.APIContainers{containerA}, nil)
-	client.On("InspectContainer", "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9").Return(&docker.Container{}, expectedError)
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{containerA}, nil)
+	client.On("InspectContainerWithContext", "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9").Return(&docker.Container{}, expectedError)
 
-	_, err := containerRepository.GetAll()
+	_, err := containerRepository.GetAll(context.Background())
 	assert.Equal(t, expectedError, err)
 }
 
+func TestGetAllSkipsContainerRemovedBeforeInspection(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{containerA, containerB}, nil)
+	client.On("InspectContainerWithContext", "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9").Return(
+		&docker.Container{},
+		&docker.NoSuchContainer{ID: "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9"},
+	)
+	client.On("InspectContainerWithContext", "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db").Return(&containerBDetails, nil)
+
+	expectedContainers := []registry.Container{
+		registry.Container{
+			ID:   "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db",
+			Name: "microservice2",
+			Port: 9000,
+			Tags: []string{"tag1", "tag2"},
+			Meta: containerBMeta,
+		},
+	}
+
+	containers, err := repository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, expectedContainers, containers)
+}
+
+func TestGetAllInspectsContainersOnceUntilStateChanges(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+	restartedContainerA := containerA
+	restartedContainerA.State = "restarting"
+
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{containerA}, nil).Twice()
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{restartedContainerA}, nil).Once()
+	client.On("InspectContainerWithContext", "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9").Return(&containerADetails, nil).Twice()
+
+	for i := 0; i < 3; i++ {
+		containers, err := repository.GetAll(context.Background())
+		assert.Nil(t, err)
+		assert.Len(t, containers, 2)
+	}
+	client.AssertExpectations(t)
+}
+
+func TestGetAllInspectsRestartedContainerAgain(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+	runningContainerA := containerA
+	runningContainerA.State = "running"
+	runningContainerA.Ports = []docker.APIPort{{PrivatePort: 80, PublicPort: 32768, Type: "tcp", IP: "0.0.0.0"}}
+	runningContainerA.Networks = docker.NetworkList{Networks: map[string]docker.ContainerNetwork{"bridge": {IPAddress: "172.17.0.2"}}}
+	// restarted container is running before and after, but it got new published port and address
+	restartedContainerA := runningContainerA
+	restartedContainerA.Ports = []docker.APIPort{{PrivatePort: 80, PublicPort: 32769, Type: "tcp", IP: "0.0.0.0"}}
+	readdressedContainerA := restartedContainerA
+	readdressedContainerA.Networks = docker.NetworkList{Networks: map[string]docker.ContainerNetwork{"bridge": {IPAddress: "172.17.0.3"}}}
+
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{runningContainerA}, nil).Twice()
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{restartedContainerA}, nil).Once()
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{readdressedContainerA}, nil).Once()
+	client.On("InspectContainerWithContext", "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9").Return(&containerADetails, nil).Times(3)
+
+	for i := 0; i < 4; i++ {
+		_, err := repository.GetAll(context.Background())
+		assert.Nil(t, err)
+	}
+	client.AssertExpectations(t)
+}
+
+func TestGetAllAddsDigestOfImageInspectedOnce(t *testing.T) {
+	client := mockDockerClient{images: map[string]*docker.Image{
+		"sha256:4f0a1c": {ID: "sha256:4f0a1c", RepoDigests: []string{"registry.example.com/brainly/web@sha256:1111", "brainly/web@sha256:9b2e"}},
+	}}
+	repository := NewContainerRepository(&client, Options{})
+	webConfig := docker.Config{Image: "brainly/web:1.2", Labels: map[string]string{}}
+	webA := containerADetails
+	webA.Image, webA.Config = "sha256:4f0a1c", &webConfig
+	webB := containerBDetails
+	webB.Image, webB.Config = "sha256:4f0a1c", &webConfig
+
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{containerA, containerB}, nil)
+	client.On("InspectContainerWithContext", containerA.ID).Return(&webA, nil)
+	client.On("InspectContainerWithContext", containerB.ID).Return(&webB, nil)
+
+	containers, err := repository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, containers)
+	for _, container := range containers {
+		assert.Equal(t, "sha256:9b2e", container.Meta["image_digest"])
+	}
+	assert.Equal(t, 1, client.imageInspections)
+}
+
+func TestContainerEventInvalidatesInspectedContainer(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+	var listener chan<- *docker.APIEvents
+
+	client.On("AddEventListener", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		listener = args.Get(0).(chan<- *docker.APIEvents)
+	})
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return([]docker.APIContainers{containerA}, nil)
+	client.On("InspectContainerWithContext", "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9").Return(&containerADetails, nil).Twice()
+
+	_, err := repository.GetAll(context.Background())
+	assert.Nil(t, err)
+
+	containersIDs := make(chan string)
+	assert.Nil(t, repository.Subscribe(containersIDs))
+	go func() {
+		listener <- &docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: containerA.ID}}
+	}()
+	<-containersIDs
+
+	_, err = repository.GetAll(context.Background())
+	assert.Nil(t, err)
+	client.AssertExpectations(t)
+}
+
+func TestGetAllLimitsConcurrentInspections(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{InspectWorkers: 2})
+	listedContainers := []docker.APIContainers{}
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+
+	for i := 0; i < 6; i++ {
+		containerID := fmt.Sprintf("container%d", i)
+		listedContainers = append(listedContainers, docker.APIContainers{ID: containerID})
+		client.On("InspectContainerWithContext", containerID).Return(&containerBDetails, nil).Run(func(args mock.Arguments) {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		})
+	}
+	client.On("ListContainers", docker.ListContainersOptions{Context: context.Background()}).Return(listedContainers, nil)
+
+	containers, err := repository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Len(t, containers, 6)
+	assert.Equal(t, 2, maxRunning)
+}
+
+func TestGetWhenContainerIsRunning(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+	runningContainer := containerBDetails
+	runningContainer.State.Running = true
+
+	client.On("InspectContainerWithContext", "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db").Return(&runningContainer, nil)
+
+	expectedContainers := []registry.Container{
+		registry.Container{
+			ID:   "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db",
+			Name: "microservice2",
+			Port: 9000,
+			Tags: []string{"tag1", "tag2"},
+			Meta: containerBMeta,
+		},
+	}
+
+	containers, err := repository.Get(context.Background(), "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db")
+
+	assert.Nil(t, err)
+	assert.Equal(t, expectedContainers, containers)
+}
+
+func TestGetWhenContainerIsStopped(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+
+	client.On("InspectContainerWithContext", "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db").Return(&containerBDetails, nil)
+
+	containers, err := repository.Get(context.Background(), "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []registry.Container{}, containers)
+}
+
+func TestGetWhenContainerWasRemoved(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+
+	client.On("InspectContainerWithContext", "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db").Return(
+		&docker.Container{},
+		&docker.NoSuchContainer{ID: "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db"},
+	)
+
+	containers, err := repository.Get(context.Background(), "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []registry.Container{}, containers)
+}
+
+func TestSubscribeForwardsOnlyContainerStateEvents(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+	var listener chan<- *docker.APIEvents
+
+	client.On("AddEventListener", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		listener = args.Get(0).(chan<- *docker.APIEvents)
+	})
+
+	containersIDs := make(chan string)
+	err := repository.Subscribe(containersIDs)
+	assert.Nil(t, err)
+
+	go func() {
+		listener <- &docker.APIEvents{Type: "container", Action: "exec_start", Actor: docker.APIActor{ID: "ignored"}}
+		listener <- &docker.APIEvents{Type: "network", Action: "connect", Actor: docker.APIActor{ID: "ignored"}}
+		listener <- &docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "container1"}}
+		listener <- &docker.APIEvents{Type: "container", Action: "health_status: healthy", Actor: docker.APIActor{ID: "container2"}}
+		listener <- &docker.APIEvents{Status: "die", ID: "container3"}
+	}()
+
+	assert.Equal(t, "container1", <-containersIDs)
+	assert.Equal(t, "container2", <-containersIDs)
+	assert.Equal(t, "container3", <-containersIDs)
+}
+
+func TestUnsubscribeRemovesEventListener(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+	var listener chan<- *docker.APIEvents
+
+	client.On("AddEventListener", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		listener = args.Get(0).(chan<- *docker.APIEvents)
+	})
+	client.On("RemoveEventListener", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		// docker client may still deliver an event while the listener is being removed, it never blocks on listeners
+		select {
+		case listener <- &docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "container1"}}:
+		default:
+		}
+	})
+
+	err := repository.Subscribe(make(chan string))
+	assert.Nil(t, err)
+
+	err = repository.Unsubscribe()
+	assert.Nil(t, err)
+	client.AssertExpectations(t)
+}
+
+func TestSubscribeAgainAfterDockerClientClosedListener(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+	listeners := make(chan chan<- *docker.APIEvents, 2)
+
+	client.On("AddEventListener", mock.Anything).Return(errors.New("connection refused")).Once()
+	client.On("AddEventListener", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		listeners <- args.Get(0).(chan<- *docker.APIEvents)
+	})
+	client.On("RemoveEventListener", mock.Anything).Return(nil).Once()
+
+	assert.Equal(t, errors.New("connection refused"), repository.Subscribe(make(chan string)))
+	containersIDs := make(chan string)
+	assert.Nil(t, repository.Subscribe(containersIDs))
+	// docker client closes all listeners when it stops monitoring events, e.g. after docker daemon restart
+	close(<-listeners)
+
+	listener := <-listeners
+	listener <- &docker.APIEvents{Type: "container", Action: "start", Actor: docker.APIActor{ID: "container1"}}
+	assert.Equal(t, "container1", <-containersIDs)
+
+	assert.NotPanics(t, func() {
+		assert.Nil(t, repository.Unsubscribe())
+		assert.Nil(t, repository.Unsubscribe())
+	})
+	client.AssertExpectations(t)
+}
+
+func TestSubscribeCoalescesEventsWhileReceiverIsBusy(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+	var listener chan<- *docker.APIEvents
+
+	client.On("AddEventListener", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		listener = args.Get(0).(chan<- *docker.APIEvents)
+	})
+
+	containersIDs := make(chan string)
+	assert.Nil(t, repository.Subscribe(containersIDs))
+
+	// listener is read although nobody receives containers IDs, so docker client does not drop events
+	for _, containerID := range []string{"container1", "container2", "container1", "container2", "container3"} {
+		select {
+		case listener <- &docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: containerID}}:
+		case <-time.After(time.Second):
+			t.Fatal("listener is blocked")
+		}
+	}
+	assert.Eventually(t, func() bool { return len(listener) == 0 }, time.Second, time.Millisecond)
+
+	assert.Equal(t, "container1", <-containersIDs)
+	assert.Equal(t, "container2", <-containersIDs)
+	assert.Equal(t, "container3", <-containersIDs)
+	select {
+	case containerID := <-containersIDs:
+		t.Fatalf("unexpected container %s", containerID)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestSubscribeWhenAddEventListenerFails(t *testing.T) {
+	client := mockDockerClient{}
+	repository := NewContainerRepository(&client, Options{})
+	expectedError := errors.New("baz")
+
+	client.On("AddEventListener", mock.Anything).Return(expectedError)
+
+	err := repository.Subscribe(make(chan string))
+	assert.Equal(t, expectedError, err)
+}
+
+func init() {
+	initialResubscribeDelay = time.Millisecond
+	maxResubscribeDelay = 4 * time.Millisecond
+}
+
 type mockDockerClient struct {
 	mock.Mock
+	// images are inspected without expectations, missing ones are reported as not found
+	images           map[string]*docker.Image
+	imageInspections int
 }
 
 func (c *mockDockerClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
@@ -164,7 +808,25 @@ func (c *mockDockerClient) ListContainers(opts docker.ListContainersOptions) ([]
 	return args.Get(0).([]docker.APIContainers), args.Error(1)
 }
 
-func (c *mockDockerClient) InspectContainer(id string) (*docker.Container, error) {
+func (c *mockDockerClient) InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error) {
 	args := c.Called(id)
 	return args.Get(0).(*docker.Container), args.Error(1)
 }
+
+func (c *mockDockerClient) AddEventListener(listener chan<- *docker.APIEvents) error {
+	args := c.Called(listener)
+	return args.Error(0)
+}
+
+func (c *mockDockerClient) RemoveEventListener(listener chan *docker.APIEvents) error {
+	args := c.Called(listener)
+	return args.Error(0)
+}
+
+func (c *mockDockerClient) InspectImage(name string) (*docker.Image, error) {
+	c.imageInspections++
+	if image, ok := c.images[name]; ok {
+		return image, nil
+	}
+	return nil, docker.ErrNoSuchImage
+}
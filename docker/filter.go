@@ -0,0 +1,116 @@
+package docker
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ignoreLabel set to true skips container
+	ignoreLabel = "pencil.ignore"
+	// enableLabel set to true selects container when Options.OptIn is set
+	enableLabel = "pencil.enable"
+)
+
+// Filter matches containers by image, name or label value
+type Filter struct {
+	field   string
+	label   string
+	pattern *regexp.Regexp
+}
+
+// ParseFilter parses filter in the form "<field>=<glob>" or "<field>~=<regexp>",
+// field is "image", "name" or "label:<label name>", e.g. "image=redis*" or "label:role~=^(db|cache)$".
+// Globs match the whole value, "*" matches any characters and "?" matches single character.
+func ParseFilter(filter string) (Filter, error) {
+	separator := strings.Index(filter, "=")
+	if separator <= 0 {
+		return Filter{}, fmt.Errorf("invalid filter %q, expected <field>=<pattern>", filter)
+	}
+	field, pattern := filter[:separator], filter[separator+1:]
+
+	expression := "^" + globToRegexp(pattern) + "$"
+	if strings.HasSuffix(field, "~") {
+		field, expression = strings.TrimSuffix(field, "~"), pattern
+	}
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return Filter{}, fmt.Errorf("invalid pattern of filter %q: %v", filter, err)
+	}
+
+	result := Filter{field: field, pattern: compiled}
+	if strings.HasPrefix(field, "label:") {
+		result.field, result.label = "label", strings.TrimPrefix(field, "label:")
+	}
+	switch {
+	case result.field == "label" && result.label == "":
+		return Filter{}, fmt.Errorf("invalid filter %q, label name is missing", filter)
+	case result.field != "image" && result.field != "name" && result.field != "label":
+		return Filter{}, fmt.Errorf("unknown field %q of filter %q", field, filter)
+	}
+	return result, nil
+}
+
+// ParseFilters parses list of filters, see ParseFilter
+func ParseFilters(filters []string) ([]Filter, error) {
+	result := []Filter{}
+	for _, filter := range filters {
+		parsed, err := ParseFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, parsed)
+	}
+	return result, nil
+}
+
+func globToRegexp(glob string) string {
+	expression := regexp.QuoteMeta(glob)
+	expression = strings.Replace(expression, `\*`, ".*", -1)
+	return strings.Replace(expression, `\?`, ".", -1)
+}
+
+// matches tells whether container matches the filter, containers without filtered label never match
+func (f Filter) matches(container *dockerContainerWrapper) bool {
+	switch f.field {
+	case "image":
+		return f.pattern.MatchString(container.Config.Image)
+	case "name":
+		return f.pattern.MatchString(strings.TrimPrefix(container.Name, "/"))
+	}
+	value, exist := container.Config.Labels[f.label]
+	return exist && f.pattern.MatchString(value)
+}
+
+// isSelected tells whether services of container should be registered:
+// containers labeled with pencil.ignore=true are always skipped,
+// only containers labeled with pencil.enable=true are selected in opt-in mode,
+// container has to match any of include filters when they are given and none of exclude filters
+func (c *dockerContainerWrapper) isSelected(options Options) bool {
+	if c.hasTrueLabel(ignoreLabel) {
+		return false
+	}
+	if options.OptIn && !c.hasTrueLabel(enableLabel) {
+		return false
+	}
+	if len(options.Include) > 0 && !c.matchesAny(options.Include) {
+		return false
+	}
+	return !c.matchesAny(options.Exclude)
+}
+
+func (c *dockerContainerWrapper) matchesAny(filters []Filter) bool {
+	for _, filter := range filters {
+		if filter.matches(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *dockerContainerWrapper) hasTrueLabel(label string) bool {
+	value, _ := strconv.ParseBool(c.Config.Labels[label])
+	return value
+}
@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"strings"
+	"sync"
+)
+
+// imageReference is parsed docker image reference,
+// e.g. "registry.example.com:5000/team/app:1.2@sha256:..." has all parts set
+type imageReference struct {
+	Registry   string
+	Namespace  string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseImageReference splits image reference into its parts, missing parts are left empty
+func parseImageReference(image string) imageReference {
+	reference := imageReference{}
+	if parts := strings.SplitN(image, "@", 2); len(parts) == 2 {
+		image, reference.Digest = parts[0], parts[1]
+	}
+	// colon after the last slash separates tag, colons before it belong to registry port
+	if colon := strings.LastIndex(image, ":"); colon > strings.LastIndex(image, "/") {
+		image, reference.Tag = image[:colon], image[colon+1:]
+	}
+
+	components := strings.Split(image, "/")
+	if len(components) > 1 && isRegistryHost(components[0]) {
+		reference.Registry, components = components[0], components[1:]
+	}
+	reference.Repository = components[len(components)-1]
+	reference.Namespace = strings.Join(components[:len(components)-1], "/")
+	return reference
+}
+
+// isRegistryHost tells whether the first component of image path is a registry, e.g. "quay.io" or "localhost:5000"
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+// Path returns namespace and repository, e.g. "team/app"
+func (r imageReference) Path() string {
+	if r.Namespace == "" {
+		return r.Repository
+	}
+	return r.Namespace + "/" + r.Repository
+}
+
+// imageDigests remembers digests of inspected images, image ID identifies immutable image
+type imageDigests struct {
+	mutex   sync.Mutex
+	digests map[string]string
+}
+
+func newImageDigests() *imageDigests {
+	return &imageDigests{digests: map[string]string{}}
+}
+
+func (d *imageDigests) get(imageID string) (string, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	digest, ok := d.digests[imageID]
+	return digest, ok
+}
+
+func (d *imageDigests) put(imageID string, digest string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.digests[imageID] = digest
+}
+
+// repoDigest picks digest of the repository container was created from, e.g. "sha256:9b2e..."
+// of "brainly/web@sha256:9b2e...", the first digest is used when the image was pushed to other repositories only
+func repoDigest(repoDigests []string, image imageReference) string {
+	digest := ""
+	for _, repoDigest := range repoDigests {
+		parts := strings.SplitN(repoDigest, "@", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		reference := parseImageReference(parts[0])
+		if reference.Registry == image.Registry && reference.Path() == image.Path() {
+			return parts[1]
+		}
+		if digest == "" {
+			digest = parts[1]
+		}
+	}
+	return digest
+}
@@ -0,0 +1,41 @@
+package docker
+
+import (
+	"context"
+	"github.com/alaa/pencil-go/metrics"
+	docker "github.com/fsouza/go-dockerclient"
+	"time"
+)
+
+const backend = "docker"
+
+// instrumentedClient records latency and failures of docker calls
+type instrumentedClient struct {
+	dockerClient
+}
+
+func (c instrumentedClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	start := time.Now()
+	containers, err := c.dockerClient.ListContainers(opts)
+	metrics.ObserveCall(backend, "list_containers", start, err)
+	return containers, err
+}
+
+func (c instrumentedClient) InspectContainerWithContext(id string, ctx context.Context) (*docker.Container, error) {
+	start := time.Now()
+	container, err := c.dockerClient.InspectContainerWithContext(id, ctx)
+	// containers removed before inspection are expected after destroy events, so they are not counted as failures
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		metrics.ObserveCall(backend, "inspect_container", start, nil)
+	} else {
+		metrics.ObserveCall(backend, "inspect_container", start, err)
+	}
+	return container, err
+}
+
+func (c instrumentedClient) InspectImage(name string) (*docker.Image, error) {
+	start := time.Now()
+	image, err := c.dockerClient.InspectImage(name)
+	metrics.ObserveCall(backend, "inspect_image", start, err)
+	return image, err
+}
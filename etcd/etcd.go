@@ -0,0 +1,158 @@
+// Package etcd keeps services in etcd as JSON values.
+//
+// Services of a host are stored under "<prefix>/<hostname>/<service ID>" keys
+// attached to a lease kept alive by the repository, so services of a crashed
+// pencil expire after the lease TTL. Services attached to another lease are
+// reported as well and synchronization attaches them to the current one.
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alaa/pencil-go/registry"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"strings"
+	"sync"
+	"time"
+)
+
+type etcdClient interface {
+	Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error)
+	Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error)
+	Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error)
+	KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error)
+}
+
+// ServiceRepository is etcd-based implementation of registry.ServiceRepository
+type ServiceRepository struct {
+	client   etcdClient
+	hostKey  string
+	leaseTTL time.Duration
+
+	mutex           sync.Mutex
+	leaseID         clientv3.LeaseID
+	cancelKeepAlive context.CancelFunc
+}
+
+// NewServiceRepository creates repository keeping services of hostname under prefix,
+// keys are removed by etcd when pencil does not refresh them for leaseTTL
+func NewServiceRepository(client etcdClient, prefix string, hostname string, leaseTTL time.Duration) *ServiceRepository {
+	return &ServiceRepository{
+		client:   instrumentedClient{client},
+		hostKey:  strings.TrimSuffix(prefix, "/") + "/" + hostname + "/",
+		leaseTTL: leaseTTL,
+	}
+}
+
+// Register stores service as JSON attached to the lease of the host
+func (r *ServiceRepository) Register(ctx context.Context, service *registry.Service) error {
+	leaseID, err := r.lease(ctx)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Put(ctx, r.hostKey+service.ID, string(value), clientv3.WithLease(leaseID))
+	return err
+}
+
+// Deregister removes service key
+func (r *ServiceRepository) Deregister(ctx context.Context, serviceID string) error {
+	_, err := r.client.Delete(ctx, r.hostKey+serviceID)
+	return err
+}
+
+// GetAll returns services of the host whichever lease they are attached to,
+// so services registered by another pencil process are reported too
+func (r *ServiceRepository) GetAll(ctx context.Context) ([]*registry.Service, error) {
+	services, _, err := r.list(ctx)
+	return services, err
+}
+
+// ForeignServices returns IDs of services of the host which are not attached to the current lease,
+// e.g. services left by previous pencil run, Register attaches them to the current lease again
+func (r *ServiceRepository) ForeignServices(ctx context.Context) ([]string, error) {
+	_, foreignIDs, err := r.list(ctx)
+	return foreignIDs, err
+}
+
+// list returns services of the host and IDs of those attached to another lease, invalid values are skipped
+func (r *ServiceRepository) list(ctx context.Context) ([]*registry.Service, []string, error) {
+	response, err := r.client.Get(ctx, r.hostKey, clientv3.WithPrefix())
+	if err != nil {
+		return nil, nil, err
+	}
+	leaseID := r.currentLease()
+	services := []*registry.Service{}
+	foreignIDs := []string{}
+	for _, kv := range response.Kvs {
+		service := &registry.Service{}
+		if err := json.Unmarshal(kv.Value, service); err != nil {
+			continue
+		}
+		services = append(services, service)
+		if leaseID == clientv3.NoLease || clientv3.LeaseID(kv.Lease) != leaseID {
+			foreignIDs = append(foreignIDs, service.ID)
+		}
+	}
+	return services, foreignIDs, nil
+}
+
+// Close stops refreshing the lease, services expire after lease TTL unless they are deregistered
+func (r *ServiceRepository) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.resetLease()
+	return nil
+}
+
+func (r *ServiceRepository) currentLease() clientv3.LeaseID {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.leaseID
+}
+
+// lease grants lease on first use and after the previous one was lost
+func (r *ServiceRepository) lease(ctx context.Context) (clientv3.LeaseID, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.leaseID != clientv3.NoLease {
+		return r.leaseID, nil
+	}
+
+	granted, err := r.client.Grant(ctx, int64(r.leaseTTL/time.Second))
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	// keep alive outlives the request which granted the lease
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	responses, err := r.client.KeepAlive(keepAliveCtx, granted.ID)
+	if err != nil {
+		cancel()
+		return clientv3.NoLease, err
+	}
+	r.leaseID, r.cancelKeepAlive = granted.ID, cancel
+	go r.watchLease(granted.ID, responses)
+	return granted.ID, nil
+}
+
+// watchLease forgets the lease when etcd stops confirming it, e.g. when it expired during network partition
+func (r *ServiceRepository) watchLease(leaseID clientv3.LeaseID, responses <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range responses {
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.leaseID == leaseID {
+		r.resetLease()
+	}
+}
+
+func (r *ServiceRepository) resetLease() {
+	if r.cancelKeepAlive != nil {
+		r.cancelKeepAlive()
+	}
+	r.leaseID, r.cancelKeepAlive = clientv3.NoLease, nil
+}
@@ -0,0 +1,161 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"testing"
+	"time"
+)
+
+const redisJSON = `{"ID":"host1:container1:6379","Service":"redis","Tags":["cache"],"Meta":null,"Address":"","Port":6379,` +
+	`"Check":{"Script":"","HTTP":"","TCP":"true","Interval":"","Timeout":"","TTL":""}}`
+
+var redis = &registry.Service{
+	ID:      "host1:container1:6379",
+	Service: "redis",
+	Tags:    []string{"cache"},
+	Port:    6379,
+	Check:   registry.ServiceCheck{TCP: "true"},
+}
+
+func TestThatRegisterPutsServiceWithLease(t *testing.T) {
+	client := new(MockEtcdClient)
+	repository := NewServiceRepository(client, "/pencil/services/", "host1", 30*time.Second)
+
+	client.On("Grant", int64(30)).Return(&clientv3.LeaseGrantResponse{ID: 7}, nil).Once()
+	client.On("KeepAlive", clientv3.LeaseID(7)).Return(make(chan *clientv3.LeaseKeepAliveResponse), nil).Once()
+	client.On("Put", "/pencil/services/host1/host1:container1:6379", redisJSON).Return(&clientv3.PutResponse{}, nil).Twice()
+
+	assert.Nil(t, repository.Register(context.Background(), redis))
+	assert.Nil(t, repository.Register(context.Background(), redis))
+
+	client.AssertExpectations(t)
+}
+
+func TestThatRegisterGrantsNewLeaseWhenKeepAliveStops(t *testing.T) {
+	client := new(MockEtcdClient)
+	repository := NewServiceRepository(client, "/pencil/services", "host1", 30*time.Second)
+	keepAlive := make(chan *clientv3.LeaseKeepAliveResponse)
+
+	client.On("Grant", int64(30)).Return(&clientv3.LeaseGrantResponse{ID: 7}, nil).Once()
+	client.On("Grant", int64(30)).Return(&clientv3.LeaseGrantResponse{ID: 8}, nil).Once()
+	client.On("KeepAlive", clientv3.LeaseID(7)).Return(keepAlive, nil)
+	client.On("KeepAlive", clientv3.LeaseID(8)).Return(make(chan *clientv3.LeaseKeepAliveResponse), nil)
+	client.On("Put", mock.Anything, mock.Anything).Return(&clientv3.PutResponse{}, nil)
+
+	assert.Nil(t, repository.Register(context.Background(), redis))
+	close(keepAlive)
+	assert.Eventually(t, func() bool { return repository.currentLease() == clientv3.NoLease }, time.Second, time.Millisecond)
+	assert.Nil(t, repository.Register(context.Background(), redis))
+
+	assert.Equal(t, clientv3.LeaseID(8), repository.currentLease())
+	client.AssertExpectations(t)
+}
+
+func TestThatRegisterReturnsErrorWhenLeaseCannotBeGranted(t *testing.T) {
+	client := new(MockEtcdClient)
+	repository := NewServiceRepository(client, "/pencil/services", "host1", 30*time.Second)
+	expectedError := errors.New("etcdserver: no leader")
+
+	client.On("Grant", int64(30)).Return(&clientv3.LeaseGrantResponse{}, expectedError)
+
+	err := repository.Register(context.Background(), redis)
+
+	assert.Equal(t, expectedError, err)
+	client.AssertNotCalled(t, "Put", mock.Anything, mock.Anything)
+}
+
+func TestThatDeregisterDeletesServiceKey(t *testing.T) {
+	client := new(MockEtcdClient)
+	repository := NewServiceRepository(client, "/pencil/services", "host1", 30*time.Second)
+
+	client.On("Delete", "/pencil/services/host1/host1:container1:6379").Return(&clientv3.DeleteResponse{}, nil)
+
+	err := repository.Deregister(context.Background(), "host1:container1:6379")
+
+	assert.Nil(t, err)
+	client.AssertExpectations(t)
+}
+
+func TestThatGetAllReturnsServicesOfAnyLease(t *testing.T) {
+	client := new(MockEtcdClient)
+	repository := NewServiceRepository(client, "/pencil/services", "host1", 30*time.Second)
+
+	client.On("Get", "/pencil/services/host1/").Return(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{
+		&mvccpb.KeyValue{Key: []byte("/pencil/services/host1/host1:container1:6379"), Value: []byte(redisJSON), Lease: 3},
+		&mvccpb.KeyValue{Key: []byte("/pencil/services/host1/broken"), Value: []byte("{"), Lease: 3},
+	}}, nil)
+
+	services, err := repository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*registry.Service{redis}, services)
+}
+
+func TestThatForeignServicesListsServicesWithoutCurrentLease(t *testing.T) {
+	client := new(MockEtcdClient)
+	repository := NewServiceRepository(client, "/pencil/services", "host1", 30*time.Second)
+	web := `{"ID":"host1:container2:80","Service":"web","Port":80}`
+
+	client.On("Grant", int64(30)).Return(&clientv3.LeaseGrantResponse{ID: 7}, nil)
+	client.On("KeepAlive", clientv3.LeaseID(7)).Return(make(chan *clientv3.LeaseKeepAliveResponse), nil)
+	client.On("Put", mock.Anything, mock.Anything).Return(&clientv3.PutResponse{}, nil)
+	client.On("Get", "/pencil/services/host1/").Return(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{
+		&mvccpb.KeyValue{Key: []byte("/pencil/services/host1/host1:container1:6379"), Value: []byte(redisJSON), Lease: 7},
+		&mvccpb.KeyValue{Key: []byte("/pencil/services/host1/host1:container2:80"), Value: []byte(web), Lease: 3},
+	}}, nil)
+
+	foreignIDs, err := repository.ForeignServices(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"host1:container1:6379", "host1:container2:80"}, foreignIDs)
+
+	assert.Nil(t, repository.Register(context.Background(), redis))
+	foreignIDs, err = repository.ForeignServices(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"host1:container2:80"}, foreignIDs)
+}
+
+func TestThatGetAllReturnsErrorWhenEtcdFails(t *testing.T) {
+	client := new(MockEtcdClient)
+	repository := NewServiceRepository(client, "/pencil/services", "host1", 30*time.Second)
+	expectedError := errors.New("context deadline exceeded")
+
+	client.On("Get", "/pencil/services/host1/").Return(&clientv3.GetResponse{}, expectedError)
+
+	_, err := repository.GetAll(context.Background())
+	assert.Equal(t, expectedError, err)
+}
+
+type MockEtcdClient struct {
+	mock.Mock
+}
+
+func (c *MockEtcdClient) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	args := c.Called(key)
+	return args.Get(0).(*clientv3.GetResponse), args.Error(1)
+}
+
+func (c *MockEtcdClient) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	args := c.Called(key, val)
+	return args.Get(0).(*clientv3.PutResponse), args.Error(1)
+}
+
+func (c *MockEtcdClient) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	args := c.Called(key)
+	return args.Get(0).(*clientv3.DeleteResponse), args.Error(1)
+}
+
+func (c *MockEtcdClient) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	args := c.Called(ttl)
+	return args.Get(0).(*clientv3.LeaseGrantResponse), args.Error(1)
+}
+
+func (c *MockEtcdClient) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	args := c.Called(id)
+	return args.Get(0).(chan *clientv3.LeaseKeepAliveResponse), args.Error(1)
+}
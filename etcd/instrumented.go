@@ -0,0 +1,43 @@
+package etcd
+
+import (
+	"context"
+	"github.com/alaa/pencil-go/metrics"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"time"
+)
+
+const backend = "etcd"
+
+// instrumentedClient records latency and failures of etcd calls
+type instrumentedClient struct {
+	etcdClient
+}
+
+func (c instrumentedClient) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	start := time.Now()
+	response, err := c.etcdClient.Get(ctx, key, opts...)
+	metrics.ObserveCall(backend, "get", start, err)
+	return response, err
+}
+
+func (c instrumentedClient) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	start := time.Now()
+	response, err := c.etcdClient.Put(ctx, key, val, opts...)
+	metrics.ObserveCall(backend, "register", start, err)
+	return response, err
+}
+
+func (c instrumentedClient) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	start := time.Now()
+	response, err := c.etcdClient.Delete(ctx, key, opts...)
+	metrics.ObserveCall(backend, "deregister", start, err)
+	return response, err
+}
+
+func (c instrumentedClient) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	start := time.Now()
+	response, err := c.etcdClient.Grant(ctx, ttl)
+	metrics.ObserveCall(backend, "grant", start, err)
+	return response, err
+}
@@ -0,0 +1,169 @@
+// Package file keeps services in a local file, e.g. for generation of static DNS zones,
+// proxy configurations or Prometheus targets.
+//
+// The file always holds the full set of services and it is replaced atomically,
+// readers never see partially written file.
+package file
+
+import (
+	"context"
+	"fmt"
+	"github.com/alaa/pencil-go/metrics"
+	"github.com/alaa/pencil-go/registry"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const backend = "file"
+
+// Format of the services file
+type Format string
+
+// Supported formats of the services file
+const (
+	// JSONFormat is JSON list of services
+	JSONFormat Format = "json"
+	// YAMLFormat is YAML list of services
+	YAMLFormat Format = "yaml"
+	// FileSDFormat is JSON read by Prometheus file_sd_configs, a target group per service
+	FileSDFormat Format = "file_sd"
+)
+
+// ServiceRepository is file-based implementation of registry.ServiceRepository
+type ServiceRepository struct {
+	path   string
+	format Format
+	// mutex serializes read-modify-write cycles of the file
+	mutex sync.Mutex
+	// unaddressed keeps services which cannot be written as Prometheus targets,
+	// they are reported as registered, so they are not registered again by every synchronization
+	unaddressed map[string]*registry.Service
+}
+
+// NewServiceRepository creates repository keeping services in the file at path
+func NewServiceRepository(path string, format Format) *ServiceRepository {
+	return &ServiceRepository{
+		path:        path,
+		format:      format,
+		unaddressed: map[string]*registry.Service{},
+	}
+}
+
+// Register adds service to the file or replaces service with the same ID,
+// services without address are skipped in file_sd format, e.g. containers labeled with address_mode=exposed
+func (r *ServiceRepository) Register(ctx context.Context, service *registry.Service) error {
+	return r.update(func(services map[string]*registry.Service) {
+		delete(r.unaddressed, service.ID)
+		if r.format == FileSDFormat && service.Address == "" {
+			log.Printf("Service %s is skipped, Prometheus targets require address given by published or internal address mode\n", service.ID)
+			r.unaddressed[service.ID] = service
+			delete(services, service.ID)
+			return
+		}
+		services[service.ID] = service
+	})
+}
+
+// Deregister removes service from the file
+func (r *ServiceRepository) Deregister(ctx context.Context, serviceID string) error {
+	return r.update(func(services map[string]*registry.Service) {
+		delete(r.unaddressed, serviceID)
+		delete(services, serviceID)
+	})
+}
+
+// GetAll reads services back from the file, there are no services until the file is written
+func (r *ServiceRepository) GetAll(ctx context.Context) ([]*registry.Service, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	services, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range r.unaddressed {
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+func (r *ServiceRepository) update(change func(services map[string]*registry.Service)) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	services, err := r.read()
+	if err != nil {
+		return err
+	}
+	servicesByID := make(map[string]*registry.Service, len(services))
+	for _, service := range services {
+		servicesByID[service.ID] = service
+	}
+	change(servicesByID)
+	return r.write(servicesByID)
+}
+
+func (r *ServiceRepository) read() (services []*registry.Service, err error) {
+	defer observeCall("read", time.Now(), &err)
+	content, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return []*registry.Service{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	services, err = decode(r.format, content)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse services file %s: %v", r.path, err)
+	}
+	return services, nil
+}
+
+// write replaces the file with the new one, services are sorted by ID so unchanged set gives the same content
+func (r *ServiceRepository) write(servicesByID map[string]*registry.Service) (err error) {
+	defer observeCall("write", time.Now(), &err)
+	services := make([]*registry.Service, 0, len(servicesByID))
+	for _, service := range servicesByID {
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	content, err := encode(r.format, services)
+	if err != nil {
+		return err
+	}
+	return writeAtomically(r.path, content)
+}
+
+// writeAtomically writes content to temporary file in the same directory and renames it over path,
+// rename within a file system either fully replaces the file or leaves it unchanged
+func writeAtomically(path string, content []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	// temporary files are private, services file is read by other programs
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// observeCall records file operation when it returns, err points to its named result
+func observeCall(call string, start time.Time, err *error) {
+	metrics.ObserveCall(backend, call, start, *err)
+}
@@ -0,0 +1,151 @@
+package file
+
+import (
+	"context"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var redis = &registry.Service{
+	ID:      "host1:container1:6379",
+	Service: "redis",
+	Tags:    []string{"pencil", "cache"},
+	Meta:    map[string]string{"container_name": "redis-1", "app.version": "7.2"},
+	Address: "10.0.0.1",
+	Port:    6379,
+	Check:   registry.ServiceCheck{TCP: "true", Interval: "10s"},
+}
+
+var web = &registry.Service{
+	ID:      "host1:container2:80",
+	Service: "web",
+	Address: "10.0.0.2",
+	Port:    80,
+}
+
+func TestThatServicesAreReadBackInEveryFormat(t *testing.T) {
+	for _, format := range []Format{JSONFormat, YAMLFormat, FileSDFormat} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		repository := NewServiceRepository(filepath.Join(dir, "services"), format)
+
+		assert.Nil(t, repository.Register(context.Background(), web), string(format))
+		assert.Nil(t, repository.Register(context.Background(), redis), string(format))
+		services, err := repository.GetAll(context.Background())
+
+		assert.Nil(t, err, string(format))
+		assert.Equal(t, []*registry.Service{redis, web}, services, string(format))
+	}
+}
+
+func TestThatDeregisterRemovesServiceFromFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	repository := NewServiceRepository(filepath.Join(dir, "services.json"), JSONFormat)
+
+	assert.Nil(t, repository.Register(context.Background(), redis))
+	assert.Nil(t, repository.Register(context.Background(), web))
+	assert.Nil(t, repository.Deregister(context.Background(), redis.ID))
+	services, err := repository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*registry.Service{web}, services)
+}
+
+func TestThatRegisterReplacesFileAndLeavesNoTemporaryFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.json")
+	repository := NewServiceRepository(path, JSONFormat)
+
+	assert.Nil(t, repository.Register(context.Background(), web))
+	assert.Nil(t, repository.Register(context.Background(), web))
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+	assert.Equal(t, os.FileMode(0644), files[0].Mode().Perm())
+	content, _ := ioutil.ReadFile(path)
+	assert.JSONEq(t, `[{"id":"host1:container2:80","name":"web","address":"10.0.0.2","port":80}]`, string(content))
+}
+
+func TestThatFileSDFormatHasTargetGroupPerService(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets.json")
+	repository := NewServiceRepository(path, FileSDFormat)
+
+	assert.Nil(t, repository.Register(context.Background(), redis))
+
+	content, _ := ioutil.ReadFile(path)
+	assert.JSONEq(t, `[{
+		"targets": ["10.0.0.1:6379"],
+		"labels": {
+			"__meta_pencil_service_id": "host1:container1:6379",
+			"__meta_pencil_service": "redis",
+			"__meta_pencil_tags": ",pencil,cache,",
+			"__meta_pencil_service_metadata_container_name": "redis-1",
+			"__meta_pencil_service_metadata_app_version": "7.2",
+			"__meta_pencil_metadata": "{\"app.version\":\"7.2\",\"container_name\":\"redis-1\"}",
+			"__meta_pencil_check_tcp": "true",
+			"__meta_pencil_check_interval": "10s"
+		}
+	}]`, string(content))
+}
+
+func TestThatFileSDFormatSkipsServicesWithoutAddress(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets.json")
+	repository := NewServiceRepository(path, FileSDFormat)
+	exposed := &registry.Service{ID: "host1:container3:80", Service: "web", Port: 80}
+
+	assert.Nil(t, repository.Register(context.Background(), exposed))
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `[]`, string(content))
+	services, err := repository.GetAll(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []*registry.Service{exposed}, services)
+
+	assert.Nil(t, repository.Deregister(context.Background(), exposed.ID))
+	services, err = repository.GetAll(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, services)
+}
+
+func TestThatGetAllReturnsNoServicesWhenFileIsMissing(t *testing.T) {
+	repository := NewServiceRepository("/nonexistent/services.yaml", YAMLFormat)
+
+	services, err := repository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*registry.Service{}, services)
+}
+
+func TestThatInvalidFileIsNotOverwritten(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.json")
+	ioutil.WriteFile(path, []byte("{"), 0644)
+	repository := NewServiceRepository(path, JSONFormat)
+
+	_, err := repository.GetAll(context.Background())
+	assert.Error(t, err)
+	assert.Error(t, repository.Register(context.Background(), web))
+
+	content, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "{", string(content))
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "pencil-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,230 @@
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alaa/pencil-go/registry"
+	"gopkg.in/yaml.v2"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Prometheus labels of target groups, they are available in relabeling like labels of other service discoveries
+const (
+	labelPrefix     = "__meta_pencil_"
+	serviceIDLabel  = labelPrefix + "service_id"
+	serviceLabel    = labelPrefix + "service"
+	tagsLabel       = labelPrefix + "tags"
+	metaLabelPrefix = labelPrefix + "service_metadata_"
+	// metaLabel keeps metadata as JSON, so keys changed into label names are read back unchanged
+	metaLabel   = labelPrefix + "metadata"
+	checkPrefix = labelPrefix + "check_"
+)
+
+var invalidLabelCharacters = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// record is service as it is kept in JSON and YAML files
+type record struct {
+	ID      string            `json:"id" yaml:"id"`
+	Name    string            `json:"name" yaml:"name"`
+	Address string            `json:"address" yaml:"address"`
+	Port    int               `json:"port" yaml:"port"`
+	Tags    []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty" yaml:"meta,omitempty"`
+	Check   *check            `json:"check,omitempty" yaml:"check,omitempty"`
+}
+
+type check struct {
+	Script   string `json:"script,omitempty" yaml:"script,omitempty"`
+	HTTP     string `json:"http,omitempty" yaml:"http,omitempty"`
+	TCP      string `json:"tcp,omitempty" yaml:"tcp,omitempty"`
+	Interval string `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	TTL      string `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+}
+
+// targetGroup is Prometheus static config read by file_sd_configs
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func encode(format Format, services []*registry.Service) ([]byte, error) {
+	switch format {
+	case JSONFormat:
+		return json.MarshalIndent(toRecords(services), "", "  ")
+	case YAMLFormat:
+		return yaml.Marshal(toRecords(services))
+	case FileSDFormat:
+		groups, err := toTargetGroups(services)
+		if err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(groups, "", "  ")
+	}
+	return nil, fmt.Errorf("unknown format %q of services file", format)
+}
+
+func decode(format Format, content []byte) ([]*registry.Service, error) {
+	switch format {
+	case JSONFormat:
+		records := []record{}
+		if err := json.Unmarshal(content, &records); err != nil {
+			return nil, err
+		}
+		return fromRecords(records), nil
+	case YAMLFormat:
+		records := []record{}
+		if err := yaml.Unmarshal(content, &records); err != nil {
+			return nil, err
+		}
+		return fromRecords(records), nil
+	case FileSDFormat:
+		groups := []targetGroup{}
+		if err := json.Unmarshal(content, &groups); err != nil {
+			return nil, err
+		}
+		return fromTargetGroups(groups)
+	}
+	return nil, fmt.Errorf("unknown format %q of services file", format)
+}
+
+func toRecords(services []*registry.Service) []record {
+	records := make([]record, 0, len(services))
+	for _, service := range services {
+		record := record{
+			ID:      service.ID,
+			Name:    service.Service,
+			Address: service.Address,
+			Port:    service.Port,
+			Tags:    service.Tags,
+			Meta:    service.Meta,
+		}
+		if service.Check != (registry.ServiceCheck{}) {
+			record.Check = &check{
+				Script:   service.Check.Script,
+				HTTP:     service.Check.HTTP,
+				TCP:      service.Check.TCP,
+				Interval: service.Check.Interval,
+				Timeout:  service.Check.Timeout,
+				TTL:      service.Check.TTL,
+			}
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func fromRecords(records []record) []*registry.Service {
+	services := make([]*registry.Service, 0, len(records))
+	for _, record := range records {
+		service := &registry.Service{
+			ID:      record.ID,
+			Service: record.Name,
+			Address: record.Address,
+			Port:    record.Port,
+			Tags:    record.Tags,
+			Meta:    record.Meta,
+		}
+		if record.Check != nil {
+			service.Check = registry.ServiceCheck{
+				Script:   record.Check.Script,
+				HTTP:     record.Check.HTTP,
+				TCP:      record.Check.TCP,
+				Interval: record.Check.Interval,
+				Timeout:  record.Check.Timeout,
+				TTL:      record.Check.TTL,
+			}
+		}
+		services = append(services, service)
+	}
+	return services
+}
+
+// toTargetGroups builds target group per service, tags are joined with commas like by consul service discovery
+// and meta keys are turned into valid label names. Services without address cannot be scraped,
+// they are registered by exposed address mode.
+func toTargetGroups(services []*registry.Service) ([]targetGroup, error) {
+	groups := make([]targetGroup, 0, len(services))
+	for _, service := range services {
+		if service.Address == "" {
+			return nil, fmt.Errorf("service %s has no address, Prometheus targets require published or internal address mode", service.ID)
+		}
+		labels := map[string]string{
+			serviceIDLabel: service.ID,
+			serviceLabel:   service.Service,
+		}
+		if len(service.Tags) > 0 {
+			labels[tagsLabel] = "," + strings.Join(service.Tags, ",") + ","
+		}
+		for key, value := range service.Meta {
+			labels[metaLabelPrefix+invalidLabelCharacters.ReplaceAllString(key, "_")] = value
+		}
+		if len(service.Meta) > 0 {
+			meta, _ := json.Marshal(service.Meta)
+			labels[metaLabel] = string(meta)
+		}
+		for name, value := range checkLabels(service.Check) {
+			if value != "" {
+				labels[checkPrefix+name] = value
+			}
+		}
+		groups = append(groups, targetGroup{
+			Targets: []string{net.JoinHostPort(service.Address, strconv.Itoa(service.Port))},
+			Labels:  labels,
+		})
+	}
+	return groups, nil
+}
+
+func fromTargetGroups(groups []targetGroup) ([]*registry.Service, error) {
+	services := make([]*registry.Service, 0, len(groups))
+	for _, group := range groups {
+		if len(group.Targets) != 1 {
+			return nil, fmt.Errorf("target group of service %q must have single target", group.Labels[serviceIDLabel])
+		}
+		host, port, err := net.SplitHostPort(group.Targets[0])
+		if err != nil {
+			return nil, err
+		}
+		service := &registry.Service{
+			ID:      group.Labels[serviceIDLabel],
+			Service: group.Labels[serviceLabel],
+			Address: host,
+		}
+		if service.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid port of target %q", group.Targets[0])
+		}
+		if tags := strings.Trim(group.Labels[tagsLabel], ","); tags != "" {
+			service.Tags = strings.Split(tags, ",")
+		}
+		if meta, exist := group.Labels[metaLabel]; exist {
+			if err := json.Unmarshal([]byte(meta), &service.Meta); err != nil {
+				return nil, fmt.Errorf("invalid metadata of service %q: %v", service.ID, err)
+			}
+		}
+		service.Check = registry.ServiceCheck{
+			Script:   group.Labels[checkPrefix+"script"],
+			HTTP:     group.Labels[checkPrefix+"http"],
+			TCP:      group.Labels[checkPrefix+"tcp"],
+			Interval: group.Labels[checkPrefix+"interval"],
+			Timeout:  group.Labels[checkPrefix+"timeout"],
+			TTL:      group.Labels[checkPrefix+"ttl"],
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+func checkLabels(check registry.ServiceCheck) map[string]string {
+	return map[string]string{
+		"script":   check.Script,
+		"http":     check.HTTP,
+		"tcp":      check.TCP,
+		"interval": check.Interval,
+		"timeout":  check.Timeout,
+		"ttl":      check.TTL,
+	}
+}
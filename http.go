@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/alaa/pencil-go/metrics"
+	"log"
+	"net/http"
+	"time"
+)
+
+const httpShutdownTimeout = 5 * time.Second
+
+// httpHandler serves metrics and admin API:
+//
+//	GET  /healthz   pencil is running
+//	GET  /readyz    docker and consul are reachable and the last synchronization succeeded
+//	GET  /services  services which should be registered for running containers
+//	GET  /diff      changes the next synchronization would apply
+//	POST /sync      runs synchronization immediately and returns its report
+func (d *daemon) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", d.healthz)
+	mux.HandleFunc("/readyz", d.readyz)
+	mux.HandleFunc("/services", d.services)
+	mux.HandleFunc("/diff", d.diff)
+	mux.HandleFunc("/sync", d.forceSync)
+	return mux
+}
+
+func (d *daemon) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzProbeTimeout limits each probe of /readyz, so backend which never answers is reported as not ready
+var readyzProbeTimeout = 2 * time.Second
+
+func (d *daemon) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	for _, backend := range d.backends {
+		checks[backend.name] = "ok"
+		ctx, cancel := context.WithTimeout(r.Context(), readyzProbeTimeout)
+		err := backend.probe(ctx)
+		cancel()
+		if err != nil {
+			checks[backend.name] = err.Error()
+			ready = false
+		}
+	}
+	switch syncTime, err := d.status.get(); {
+	case syncTime.IsZero():
+		checks["sync"] = "not synchronized yet"
+		ready = false
+	case err != nil:
+		checks["sync"] = err.Error()
+		ready = false
+	default:
+		checks["sync"] = "ok"
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]interface{}{"ready": ready, "checks": checks})
+}
+
+func (d *daemon) services(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(d.cfg.SyncTimeout))
+	defer cancel()
+	services, err := d.registry.DesiredServices(ctx)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, services)
+}
+
+func (d *daemon) diff(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(d.cfg.SyncTimeout))
+	defer cancel()
+	plan, err := d.registry.Plan(ctx)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// forceSync hands synchronization over to the synchronization loop, so it never runs concurrently with another one
+func (d *daemon) forceSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	result := make(chan syncResult, 1)
+	select {
+	case d.syncRequests <- result:
+	case <-r.Context().Done():
+		return
+	}
+	synced := <-result
+
+	failed := []string{}
+	for _, serviceError := range synced.report.Failed {
+		failed = append(failed, serviceError.Error())
+	}
+	response := map[string]interface{}{
+		"registered":   synced.report.Registered,
+		"updated":      synced.report.Updated,
+		"deregistered": synced.report.Deregistered,
+		"failed":       failed,
+	}
+	status := http.StatusOK
+	if synced.err != nil {
+		response["error"] = synced.err.Error()
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error occured during writing HTTP response: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// startHTTPServer serves handler in background, failures are only logged so they never stop synchronization
+func startHTTPServer(address string, handler http.Handler) *http.Server {
+	server := &http.Server{Addr: address, Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("HTTP server on %s stopped: %v\n", address, err)
+		}
+	}()
+	return server
+}
+
+func stopHTTPServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error occured during stopping HTTP server: %v\n", err)
+	}
+}
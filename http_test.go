@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/alaa/pencil-go/config"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/alaa/pencil-go/registry/memory"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestDaemon(backends ...backend) (*daemon, *memory.ServiceRepository) {
+	cfg := config.Default()
+	cfg.Hostname = "host1"
+	containerRepository := memory.NewContainerRepository(registry.Container{ID: "container1", Name: "web", Port: 80})
+	serviceRepository := memory.NewServiceRepository()
+	return &daemon{
+		cfg:          cfg,
+		registry:     registry.NewRegistry(containerRepository, serviceRepository, cfg.Hostname),
+		backends:     backends,
+		status:       &syncStatus{},
+		syncRequests: make(chan chan syncResult),
+	}, serviceRepository
+}
+
+func serveRequest(d *daemon, method string, path string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	recorder := httptest.NewRecorder()
+	d.httpHandler().ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	body := map[string]interface{}{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return recorder, body
+}
+
+func TestReadyzRequiresReachableBackendsAndSuccessfulSync(t *testing.T) {
+	consulErr := errors.New("connection refused")
+	consulProbe := func() error { return consulErr }
+	d, _ := newTestDaemon(backend{"docker", func(ctx context.Context) error { return nil }}, backend{"consul", func(ctx context.Context) error { return consulProbe() }})
+
+	recorder, body := serveRequest(d, "GET", "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, map[string]interface{}{"docker": "ok", "consul": "connection refused", "sync": "not synchronized yet"}, body["checks"])
+
+	consulProbe = func() error { return nil }
+	d.status.set(nil)
+	recorder, body = serveRequest(d, "GET", "/readyz")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, true, body["ready"])
+
+	d.status.set(errors.New("consul unavailable"))
+	recorder, _ = serveRequest(d, "GET", "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
+
+func TestReadyzReportsHangingBackend(t *testing.T) {
+	previousTimeout := readyzProbeTimeout
+	readyzProbeTimeout = 10 * time.Millisecond
+	defer func() { readyzProbeTimeout = previousTimeout }()
+	hangingProbe := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	d, _ := newTestDaemon(backend{"consul", hangingProbe})
+	d.status.set(nil)
+
+	recorder, body := serveRequest(d, "GET", "/readyz")
+
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, map[string]interface{}{"consul": "context deadline exceeded", "sync": "ok"}, body["checks"])
+}
+
+func TestDiffShowsPlannedChanges(t *testing.T) {
+	d, serviceRepository := newTestDaemon()
+
+	recorder, body := serveRequest(d, "GET", "/diff")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, body["Register"], 1)
+	assert.Empty(t, serviceRepository.Services())
+}
+
+func TestSyncRunsSynchronizationInLoop(t *testing.T) {
+	d, serviceRepository := newTestDaemon()
+	go func() {
+		result := <-d.syncRequests
+		report, err := d.synchronize(context.Background())
+		result <- syncResult{report, err}
+	}()
+
+	recorder, body := serveRequest(d, "POST", "/sync")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []interface{}{map[string]interface{}{"ServiceID": "host1:container1:80"}}, body["registered"])
+	assert.Len(t, serviceRepository.Services(), 1)
+	syncTime, err := d.status.get()
+	assert.False(t, syncTime.IsZero())
+	assert.Nil(t, err)
+}
+
+func TestSyncAcceptsOnlyPost(t *testing.T) {
+	d, _ := newTestDaemon()
+
+	recorder, _ := serveRequest(d, "GET", "/sync")
+
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, "POST", recorder.Header().Get("Allow"))
+}
@@ -1,33 +1,137 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"github.com/alaa/pencil-go/consul"
+	"github.com/alaa/pencil-go/config"
 	"github.com/alaa/pencil-go/docker"
-	"github.com/alaa/pencil-go/registry"
 	dockerclient "github.com/fsouza/go-dockerclient"
 	consulclient "github.com/hashicorp/consul/api"
 	"log"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/template"
 )
 
 func main() {
-	fmt.Println("starting pencil ...\n")
-	registry := registry.NewRegistry(getContainerRepository(), getServiceRepository())
-	for range time.Tick(5 * time.Second) {
-		err := registry.Synchronize()
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v\n", err)
+	}
+
+	if cfg.DryRun {
+		daemon, err := newDaemon(cfg)
 		if err != nil {
-			log.Printf("Error occured during synchronization: %v\n", err)
+			log.Fatalln(err)
 		}
+		err = daemon.dryRun(os.Stdout)
+		daemon.close()
+		if err != nil {
+			log.Fatalf("Cannot plan synchronization: %v\n", err)
+		}
+		return
+	}
+
+	fmt.Println("starting pencil ...")
+	daemon, err := newDaemon(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for daemon.run(signals) == syscall.SIGHUP {
+		daemon = reload(daemon)
+	}
+	daemon.shutdown()
+}
+
+// reload keeps the current daemon when the new configuration cannot be applied.
+// The reloaded daemon synchronizes before the current one is closed, so services attached
+// to the session or lease of the current backend are taken over before it ends.
+func reload(current *daemon) *daemon {
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Printf("Configuration not reloaded, it is invalid: %v\n", err)
+		return current
+	}
+	reloaded, err := newDaemon(cfg)
+	if err != nil {
+		log.Printf("Configuration not reloaded: %v\n", err)
+		return current
 	}
+	reloaded.synchronize(context.Background())
+	current.close()
+	log.Println("Configuration reloaded")
+	return reloaded
 }
 
-func getContainerRepository() registry.ContainerRepository {
-	client, _ := dockerclient.NewClientFromEnv()
-	return docker.NewContainerRepository(client)
+func getContainerRepository(cfg *config.Config, client *dockerclient.Client) (*docker.ContainerRepository, error) {
+	include, err := docker.ParseFilters(cfg.Docker.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := docker.ParseFilters(cfg.Docker.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	nameTemplate, err := template.New("name").Parse(cfg.Docker.NameTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return docker.NewContainerRepository(client, docker.Options{
+		AddressMode:    docker.AddressMode(cfg.Docker.AddressMode),
+		AdvertiseIP:    cfg.Docker.AdvertiseIP,
+		Network:        cfg.Docker.Network,
+		Naming:         docker.Naming(cfg.Docker.Naming),
+		NameTemplate:   nameTemplate,
+		Hostname:       cfg.Hostname,
+		InspectWorkers: cfg.Docker.InspectWorkers,
+		OptIn:          cfg.Docker.OptIn,
+		Include:        include,
+		Exclude:        exclude,
+	}), nil
 }
 
-func getServiceRepository() registry.ServiceRepository {
-	consulClient, _ := consulclient.NewClient(consulclient.DefaultConfig())
-	return consul.NewServiceRepository(consulClient.Agent())
+func newDockerClient(cfg config.Docker) (*dockerclient.Client, error) {
+	switch {
+	case cfg.Endpoint == "":
+		return dockerclient.NewClientFromEnv()
+	case cfg.TLSCert != "":
+		return dockerclient.NewTLSClient(cfg.Endpoint, cfg.TLSCert, cfg.TLSKey, cfg.TLSCACert)
+	}
+	return dockerclient.NewClient(cfg.Endpoint)
+}
+
+// newConsulConfig overrides consul client defaults only with given settings
+func newConsulConfig(cfg config.Consul) *consulclient.Config {
+	consulConfig := consulclient.DefaultConfig()
+	if cfg.Address != "" {
+		consulConfig.Address = cfg.Address
+	}
+	if cfg.Scheme != "" {
+		consulConfig.Scheme = cfg.Scheme
+	}
+	if cfg.Datacenter != "" {
+		consulConfig.Datacenter = cfg.Datacenter
+	}
+	if cfg.Token != "" {
+		consulConfig.Token = cfg.Token
+	}
+	if cfg.TLSCAFile != "" {
+		consulConfig.TLSConfig.CAFile = cfg.TLSCAFile
+	}
+	if cfg.TLSCertFile != "" {
+		consulConfig.TLSConfig.CertFile = cfg.TLSCertFile
+		consulConfig.TLSConfig.KeyFile = cfg.TLSKeyFile
+	}
+	if cfg.TLSSkipVerify {
+		consulConfig.TLSConfig.InsecureSkipVerify = true
+	}
+	return consulConfig
 }
@@ -0,0 +1,85 @@
+// Package metrics exposes pencil synchronization and backend calls as Prometheus metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "pencil"
+
+var (
+	// SyncDuration observes duration of full synchronizations
+	SyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of full synchronization of services with containers.",
+	})
+	// LastSuccessfulSync holds unix time of the last full synchronization finished without errors
+	LastSuccessfulSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last full synchronization finished without errors.",
+	})
+	// ContainersSeen holds number of containers found by the last full synchronization or plan
+	ContainersSeen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "containers",
+		Help:      "Number of containers endpoints seen by the last full synchronization or plan.",
+	})
+	// ServicesRegistered counts services registered or updated in service backend
+	ServicesRegistered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "services_registered_total",
+		Help:      "Number of services registered or updated.",
+	})
+	// ServicesDeregistered counts services removed from service backend
+	ServicesDeregistered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "services_deregistered_total",
+		Help:      "Number of services deregistered.",
+	})
+	// BackendErrors counts failed calls by backend, e.g. "consul", and call, e.g. "register"
+	BackendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_errors_total",
+		Help:      "Number of failed backend calls.",
+	}, []string{"backend", "call"})
+	// BackendCallDuration observes latency of backend calls by backend and call
+	BackendCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_call_duration_seconds",
+		Help:      "Latency of backend calls.",
+	}, []string{"backend", "call"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		SyncDuration,
+		LastSuccessfulSync,
+		ContainersSeen,
+		ServicesRegistered,
+		ServicesDeregistered,
+		BackendErrors,
+		BackendCallDuration,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves all pencil metrics in Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ObserveCall records latency of backend call started at start and counts it as failed when err is not nil
+func ObserveCall(backend string, call string, start time.Time, err error) {
+	BackendCallDuration.WithLabelValues(backend, call).Observe(time.Since(start).Seconds())
+	if err != nil {
+		BackendErrors.WithLabelValues(backend, call).Inc()
+	}
+}
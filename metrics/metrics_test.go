@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserveCallCountsOnlyFailedCalls(t *testing.T) {
+	succeededErrors := testutil.ToFloat64(BackendErrors.WithLabelValues("test", "succeeded"))
+	failedErrors := testutil.ToFloat64(BackendErrors.WithLabelValues("test", "failed"))
+	succeededCalls := sampleCount(BackendCallDuration.WithLabelValues("test", "succeeded"))
+	failedCalls := sampleCount(BackendCallDuration.WithLabelValues("test", "failed"))
+
+	ObserveCall("test", "succeeded", time.Now(), nil)
+	ObserveCall("test", "failed", time.Now(), errors.New("foo"))
+
+	assert.Equal(t, succeededErrors, testutil.ToFloat64(BackendErrors.WithLabelValues("test", "succeeded")))
+	assert.Equal(t, failedErrors+1, testutil.ToFloat64(BackendErrors.WithLabelValues("test", "failed")))
+	assert.Equal(t, succeededCalls+1, sampleCount(BackendCallDuration.WithLabelValues("test", "succeeded")))
+	assert.Equal(t, failedCalls+1, sampleCount(BackendCallDuration.WithLabelValues("test", "failed")))
+}
+
+func TestHandlerServesPencilMetrics(t *testing.T) {
+	syncs := sampleCount(SyncDuration)
+	SyncDuration.Observe(1)
+	recorder := httptest.NewRecorder()
+
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := ioutil.ReadAll(recorder.Body)
+	assert.Equal(t, 200, recorder.Code)
+	assert.True(t, strings.Contains(string(body), fmt.Sprintf("pencil_sync_duration_seconds_count %d", syncs+1)))
+	assert.True(t, strings.Contains(string(body), "pencil_last_successful_sync_timestamp_seconds"))
+}
+
+// sampleCount reads number of observations made by histogram
+func sampleCount(histogram prometheus.Observer) uint64 {
+	metric := &dto.Metric{}
+	histogram.(prometheus.Metric).Write(metric)
+	return metric.GetHistogram().GetSampleCount()
+}
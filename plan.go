@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/alaa/pencil-go/registry"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// dryRun prints changes the next synchronization would apply, nothing is registered or deregistered
+func (d *daemon) dryRun(w io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.SyncTimeout))
+	defer cancel()
+	plan, err := d.registry.Plan(ctx)
+	if err != nil {
+		return err
+	}
+	if d.cfg.Output == "json" {
+		return printPlanJSON(w, plan)
+	}
+	return printPlanTable(w, plan)
+}
+
+func printPlanJSON(w io.Writer, plan *registry.Plan) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
+}
+
+func printPlanTable(w io.Writer, plan *registry.Plan) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ACTION\tBACKEND\tSERVICE ID\tNAME\tADDRESS\tPORT\tTAGS")
+	for _, planned := range plan.Register {
+		printServiceRow(table, "register", planned.Backend, planned.Service)
+	}
+	for _, planned := range plan.Update {
+		printServiceRow(table, "update", planned.Backend, planned.Service)
+	}
+	for _, service := range plan.Deregister {
+		fmt.Fprintf(table, "deregister\t%s\t%s\t\t\t\t\n", service.Backend, service.ServiceID)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d to register, %d to update, %d to deregister\n",
+		len(plan.Register), len(plan.Update), len(plan.Deregister))
+	return err
+}
+
+func printServiceRow(w io.Writer, action string, backend string, service *registry.Service) {
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+		action, backend, service.ID, service.Service, service.Address, service.Port, strings.Join(service.Tags, ","))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/alaa/pencil-go/registry/memory"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDryRunPrintsPlanAsTable(t *testing.T) {
+	d, serviceRepository := newTestDaemon()
+	serviceRepository.Register(context.Background(), &registry.Service{ID: "host1:container2:22", Service: "ssh", Port: 22})
+	output := bytes.Buffer{}
+
+	err := d.dryRun(&output)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "ACTION      BACKEND  SERVICE ID           NAME  ADDRESS  PORT  TAGS\n"+
+		"register             host1:container1:80  web            80    \n"+
+		"deregister           host1:container2:22                       \n"+
+		"1 to register, 0 to update, 1 to deregister\n", output.String())
+	assert.Len(t, serviceRepository.Services(), 1)
+}
+
+func TestDryRunPrintsBackendOfCompositeChanges(t *testing.T) {
+	d, consul := newTestDaemon()
+	etcd := memory.NewServiceRepository(&registry.Service{ID: "host1:container1:80", Service: "web", Port: 80})
+	composite := registry.NewCompositeServiceRepository(
+		registry.Backend{Name: "consul", Repository: consul},
+		registry.Backend{Name: "etcd", Repository: etcd},
+	)
+	d.registry = registry.NewRegistry(memory.NewContainerRepository(registry.Container{ID: "container1", Name: "web", Port: 80}), composite, "host1")
+	output := bytes.Buffer{}
+
+	err := d.dryRun(&output)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "ACTION    BACKEND  SERVICE ID           NAME  ADDRESS  PORT  TAGS\n"+
+		"register  consul   host1:container1:80  web            80    \n"+
+		"1 to register, 0 to update, 0 to deregister\n", output.String())
+}
+
+func TestDryRunPrintsServicesOfAnotherLeaseAsUpdates(t *testing.T) {
+	d, _ := newTestDaemon()
+	etcd := &leasedRepository{memory.NewServiceRepository(&registry.Service{ID: "host1:container1:80", Service: "web", Port: 80})}
+	d.registry = registry.NewRegistry(memory.NewContainerRepository(registry.Container{ID: "container1", Name: "web", Port: 80}), etcd, "host1")
+	output := bytes.Buffer{}
+
+	err := d.dryRun(&output)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "ACTION  BACKEND  SERVICE ID           NAME  ADDRESS  PORT  TAGS\n"+
+		"update           host1:container1:80  web            80    \n"+
+		"0 to register, 1 to update, 0 to deregister\n", output.String())
+	assert.Equal(t, 0, etcd.Calls(memory.RegisterCall))
+}
+
+func TestDryRunPrintsPlanAsJSON(t *testing.T) {
+	d, _ := newTestDaemon()
+	d.cfg.Output = "json"
+	output := bytes.Buffer{}
+
+	err := d.dryRun(&output)
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"Register": [{"ID": "host1:container1:80", "Service": "web", "Tags": null, "Meta": null, "Address": "", "Port": 80,
+			"Check": {"Script": "", "HTTP": "", "TCP": "", "Interval": "", "Timeout": "", "TTL": ""}}],
+		"Update": [],
+		"Deregister": []
+	}`, output.String())
+}
+
+// leasedRepository attaches all its services to a lease of another process
+type leasedRepository struct {
+	*memory.ServiceRepository
+}
+
+func (r *leasedRepository) ForeignServices(ctx context.Context) ([]string, error) {
+	services, err := r.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	serviceIDs := []string{}
+	for _, service := range services {
+		serviceIDs = append(serviceIDs, service.ID)
+	}
+	return serviceIDs, nil
+}
@@ -0,0 +1,76 @@
+package registry
+
+import "context"
+
+// Backend is named service repository of CompositeServiceRepository
+type Backend struct {
+	Name       string
+	Repository ServiceRepository
+}
+
+// CompositeServiceRepository registers services in several backends at once, e.g. during migration between them.
+// Registry synchronizes each backend independently, so a backend which missed changes catches up
+// without registering services again in the others.
+type CompositeServiceRepository struct {
+	backends []Backend
+}
+
+// NewCompositeServiceRepository creates repository fanning out to backends
+func NewCompositeServiceRepository(backends ...Backend) *CompositeServiceRepository {
+	return &CompositeServiceRepository{backends}
+}
+
+// Backends returns wrapped backends in the order they were given
+func (r *CompositeServiceRepository) Backends() []Backend {
+	return r.backends
+}
+
+// GetAll returns services registered in any backend, definition from the first backend wins when backends differ
+func (r *CompositeServiceRepository) GetAll(ctx context.Context) ([]*Service, error) {
+	services := []*Service{}
+	seen := map[string]bool{}
+	err := r.each(func(backend Backend) error {
+		backendServices, err := backend.Repository.GetAll(ctx)
+		if err != nil {
+			return err
+		}
+		for _, service := range backendServices {
+			if !seen[service.ID] {
+				seen[service.ID] = true
+				services = append(services, service)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+// Register registers service in every backend, failure of one backend does not stop the others
+func (r *CompositeServiceRepository) Register(ctx context.Context, service *Service) error {
+	return r.each(func(backend Backend) error {
+		return backend.Repository.Register(ctx, service)
+	})
+}
+
+// Deregister deregisters service from every backend, failure of one backend does not stop the others
+func (r *CompositeServiceRepository) Deregister(ctx context.Context, serviceID string) error {
+	return r.each(func(backend Backend) error {
+		return backend.Repository.Deregister(ctx, serviceID)
+	})
+}
+
+func (r *CompositeServiceRepository) each(call func(backend Backend) error) error {
+	errs := BackendErrors{}
+	for _, backend := range r.backends {
+		if err := call(backend); err != nil {
+			errs = append(errs, &BackendError{backend.Name, err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
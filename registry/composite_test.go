@@ -0,0 +1,123 @@
+package registry_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/alaa/pencil-go/registry/memory"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var web = &registry.Service{ID: "host1:container1:80", Service: "web", Port: 80}
+var redis = &registry.Service{ID: "host1:container2:6379", Service: "redis", Port: 6379}
+
+func TestCompositeRegistersInEveryBackend(t *testing.T) {
+	consul, etcd := memory.NewServiceRepository(), memory.NewServiceRepository()
+	repository := registry.NewCompositeServiceRepository(registry.Backend{"consul", consul}, registry.Backend{"etcd", etcd})
+
+	assert.Nil(t, repository.Register(context.Background(), web))
+	assert.Nil(t, repository.Register(context.Background(), redis))
+	assert.Nil(t, repository.Deregister(context.Background(), redis.ID))
+
+	assert.Equal(t, []*registry.Service{web}, consul.Services())
+	assert.Equal(t, []*registry.Service{web}, etcd.Services())
+}
+
+func TestCompositeIsolatesFailingBackend(t *testing.T) {
+	consul, etcd := memory.NewServiceRepository(), memory.NewServiceRepository()
+	repository := registry.NewCompositeServiceRepository(registry.Backend{"consul", consul}, registry.Backend{"etcd", etcd})
+	etcdError := errors.New("etcdserver: no leader")
+	etcd.FailNth(memory.RegisterCall, 1, etcdError)
+
+	err := repository.Register(context.Background(), web)
+
+	assert.Equal(t, registry.BackendErrors{{Backend: "etcd", Err: etcdError}}, err)
+	assert.Equal(t, "1 backends failed to synchronize: etcd: etcdserver: no leader", err.Error())
+	assert.Equal(t, []*registry.Service{web}, consul.Services())
+}
+
+func TestCompositeReturnsServicesOfAllBackends(t *testing.T) {
+	updatedWeb := &registry.Service{ID: web.ID, Service: "web", Port: 8080}
+	repository := registry.NewCompositeServiceRepository(
+		registry.Backend{"consul", memory.NewServiceRepository(web)},
+		registry.Backend{"etcd", memory.NewServiceRepository(updatedWeb, redis)},
+	)
+
+	services, err := repository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*registry.Service{web, redis}, services)
+}
+
+func TestSynchronizeCatchesUpLaggingBackend(t *testing.T) {
+	containers := memory.NewContainerRepository(
+		registry.Container{ID: "container1", Name: "web", Port: 80},
+		registry.Container{ID: "container2", Name: "redis", Port: 6379},
+	)
+	consul, etcd := memory.NewServiceRepository(web, redis), memory.NewServiceRepository(web)
+	composite := registry.NewCompositeServiceRepository(registry.Backend{"consul", consul}, registry.Backend{"etcd", etcd})
+	reg := registry.NewRegistry(containers, composite, "host1")
+
+	report, err := reg.Synchronize(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []registry.ServiceChange{{ServiceID: redis.ID, Backend: "etcd"}}, report.Registered)
+	assert.Equal(t, 0, consul.Calls(memory.RegisterCall))
+	assert.Equal(t, 1, etcd.Calls(memory.RegisterCall))
+	assert.Equal(t, []*registry.Service{web, redis}, etcd.Services())
+	assert.Equal(t, 1, containers.Calls(memory.GetAllCall))
+}
+
+func TestSynchronizeContinuesWithOtherBackendsWhenOneFails(t *testing.T) {
+	containers := memory.NewContainerRepository(
+		registry.Container{ID: "container1", Name: "web", Port: 80},
+		registry.Container{ID: "container2", Name: "redis", Port: 6379},
+	)
+	consul, etcd := memory.NewServiceRepository(), memory.NewServiceRepository()
+	composite := registry.NewCompositeServiceRepository(registry.Backend{"consul", consul}, registry.Backend{"etcd", etcd})
+	reg := registry.NewRegistry(containers, composite, "host1")
+	consulError := errors.New("consul unavailable")
+	consul.FailNth(memory.GetAllCall, 1, consulError)
+	registerError := errors.New("permission denied")
+	etcd.FailID(redis.ID, registerError)
+
+	report, err := reg.Synchronize(context.Background())
+
+	failure := &registry.ServiceError{ServiceID: redis.ID, Operation: "register", Err: registerError, Backend: "etcd"}
+	assert.Equal(t, registry.BackendErrors{
+		{Backend: "consul", Err: consulError},
+		{Backend: "etcd", Err: &registry.SyncError{Errors: []*registry.ServiceError{failure}}},
+	}, err)
+	assert.Equal(t, []registry.ServiceChange{{ServiceID: web.ID, Backend: "etcd"}}, report.Registered)
+	assert.Equal(t, []*registry.ServiceError{failure}, report.Failed)
+	assert.Equal(t, []*registry.Service{web}, etcd.Services())
+
+	consul.ClearFaults()
+	etcd.ClearFaults()
+	report, err = reg.Synchronize(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []registry.ServiceChange{
+		{ServiceID: web.ID, Backend: "consul"},
+		{ServiceID: redis.ID, Backend: "consul"},
+		{ServiceID: redis.ID, Backend: "etcd"},
+	}, report.Registered)
+	assert.Equal(t, consul.Services(), etcd.Services())
+}
+
+func TestPlanNamesBackendOfEveryChange(t *testing.T) {
+	containers := memory.NewContainerRepository(registry.Container{ID: "container1", Name: "web", Port: 80})
+	consul, etcd := memory.NewServiceRepository(redis), memory.NewServiceRepository()
+	composite := registry.NewCompositeServiceRepository(registry.Backend{"consul", consul}, registry.Backend{"etcd", etcd})
+	reg := registry.NewRegistry(containers, composite, "host1")
+
+	plan, err := reg.Plan(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, &registry.Plan{
+		Register:   []registry.PlannedService{{Service: web, Backend: "consul"}, {Service: web, Backend: "etcd"}},
+		Update:     []registry.PlannedService{},
+		Deregister: []registry.ServiceChange{{ServiceID: redis.ID, Backend: "consul"}},
+	}, plan)
+}
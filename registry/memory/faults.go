@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Names of repository calls used by fault injection
+const (
+	GetAllCall     = "GetAll"
+	GetCall        = "Get"
+	RegisterCall   = "Register"
+	DeregisterCall = "Deregister"
+)
+
+// Faults injects latency and errors into calls of a repository, zero value injects nothing.
+// It is embedded into repositories, so faults are configured directly on them.
+type Faults struct {
+	mutex   sync.Mutex
+	latency time.Duration
+	calls   map[string]int
+	// nth holds errors returned by Nth call of a method
+	nth map[string]map[int]error
+	// ids holds errors returned by every call concerning a service or container, i.e. partial failures
+	ids map[string]error
+}
+
+// SetLatency delays every call, delayed call returns context error when its context is done first
+func (f *Faults) SetLatency(latency time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.latency = latency
+}
+
+// FailNth makes the nth call of method fail with err, calls are counted from 1 since the repository was created
+func (f *Faults) FailNth(call string, n int, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.nth == nil {
+		f.nth = map[string]map[int]error{}
+	}
+	if f.nth[call] == nil {
+		f.nth[call] = map[int]error{}
+	}
+	f.nth[call][n] = err
+}
+
+// FailID makes every call concerning service or container with the given ID fail with err,
+// other services and containers are served normally
+func (f *Faults) FailID(id string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.ids == nil {
+		f.ids = map[string]error{}
+	}
+	f.ids[id] = err
+}
+
+// ClearFaults removes injected latency and errors, calls counters are kept
+func (f *Faults) ClearFaults() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.latency, f.nth, f.ids = 0, nil, nil
+}
+
+// Calls returns number of calls of method made so far, including failed ones
+func (f *Faults) Calls(call string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls[call]
+}
+
+// inject counts the call and returns error injected for it, id is empty for calls concerning all entities
+func (f *Faults) inject(ctx context.Context, call string, id string) error {
+	f.mutex.Lock()
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	f.calls[call]++
+	err := f.nth[call][f.calls[call]]
+	if err == nil && id != "" {
+		err = f.ids[id]
+	}
+	latency := f.latency
+	f.mutex.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
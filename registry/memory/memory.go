@@ -0,0 +1,179 @@
+// Package memory provides in-memory implementations of registry repositories.
+//
+// They are safe for concurrent use and support fault injection, so synchronization
+// scenarios, including failing and slow backends, can be run without docker or consul.
+package memory
+
+import (
+	"context"
+	"github.com/alaa/pencil-go/registry"
+	"sort"
+	"sync"
+)
+
+// ContainerRepository is in-memory implementation of registry.ContainerRepository,
+// it keeps a container entry per registered port like docker.ContainerRepository
+type ContainerRepository struct {
+	Faults
+	mutex      sync.RWMutex
+	containers []registry.Container
+}
+
+// NewContainerRepository creates repository with the given running containers
+func NewContainerRepository(containers ...registry.Container) *ContainerRepository {
+	repository := &ContainerRepository{}
+	repository.Set(containers...)
+	return repository
+}
+
+// Set replaces running containers
+func (r *ContainerRepository) Set(containers ...registry.Container) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.containers = make([]registry.Container, 0, len(containers))
+	for _, container := range containers {
+		r.containers = append(r.containers, cloneContainer(container))
+	}
+}
+
+// Add starts containers
+func (r *ContainerRepository) Add(containers ...registry.Container) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, container := range containers {
+		r.containers = append(r.containers, cloneContainer(container))
+	}
+}
+
+// Remove stops container, entries of all its ports are removed
+func (r *ContainerRepository) Remove(containerID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	running := r.containers[:0]
+	for _, container := range r.containers {
+		if container.ID != containerID {
+			running = append(running, container)
+		}
+	}
+	r.containers = running
+}
+
+// GetAll returns all running containers
+func (r *ContainerRepository) GetAll(ctx context.Context) ([]registry.Container, error) {
+	if err := r.inject(ctx, GetAllCall, ""); err != nil {
+		return nil, err
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	containers := make([]registry.Container, 0, len(r.containers))
+	for _, container := range r.containers {
+		containers = append(containers, cloneContainer(container))
+	}
+	return containers, nil
+}
+
+// Get returns entries of running container, there are none when container is stopped
+func (r *ContainerRepository) Get(ctx context.Context, containerID string) ([]registry.Container, error) {
+	if err := r.inject(ctx, GetCall, containerID); err != nil {
+		return nil, err
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	containers := []registry.Container{}
+	for _, container := range r.containers {
+		if container.ID == containerID {
+			containers = append(containers, cloneContainer(container))
+		}
+	}
+	return containers, nil
+}
+
+// ServiceRepository is in-memory implementation of registry.ServiceRepository
+type ServiceRepository struct {
+	Faults
+	mutex    sync.RWMutex
+	services map[string]*registry.Service
+}
+
+// NewServiceRepository creates repository with the given services registered
+func NewServiceRepository(services ...*registry.Service) *ServiceRepository {
+	repository := &ServiceRepository{services: map[string]*registry.Service{}}
+	for _, service := range services {
+		repository.services[service.ID] = cloneService(service)
+	}
+	return repository
+}
+
+// GetAll returns registered services sorted by ID
+func (r *ServiceRepository) GetAll(ctx context.Context) ([]*registry.Service, error) {
+	if err := r.inject(ctx, GetAllCall, ""); err != nil {
+		return nil, err
+	}
+	return r.Services(), nil
+}
+
+// Register adds service or replaces service with the same ID
+func (r *ServiceRepository) Register(ctx context.Context, service *registry.Service) error {
+	if err := r.inject(ctx, RegisterCall, service.ID); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.services[service.ID] = cloneService(service)
+	return nil
+}
+
+// Deregister removes service, removing unknown service is not an error
+func (r *ServiceRepository) Deregister(ctx context.Context, serviceID string) error {
+	if err := r.inject(ctx, DeregisterCall, serviceID); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.services, serviceID)
+	return nil
+}
+
+// Services returns registered services sorted by ID, unlike GetAll it is neither counted nor faulted
+func (r *ServiceRepository) Services() []*registry.Service {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	services := make([]*registry.Service, 0, len(r.services))
+	for _, service := range r.services {
+		services = append(services, cloneService(service))
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services
+}
+
+// cloneContainer copies container, so callers cannot change the repository through its tags or meta
+func cloneContainer(container registry.Container) registry.Container {
+	container.Tags = cloneStrings(container.Tags)
+	container.Meta = cloneMeta(container.Meta)
+	return container
+}
+
+func cloneService(service *registry.Service) *registry.Service {
+	clone := *service
+	clone.Tags = cloneStrings(service.Tags)
+	clone.Meta = cloneMeta(service.Meta)
+	return &clone
+}
+
+func cloneStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string{}, values...)
+}
+
+func cloneMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	clone := make(map[string]string, len(meta))
+	for key, value := range meta {
+		clone[key] = value
+	}
+	return clone
+}
@@ -0,0 +1,135 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+var web = registry.Container{ID: "container1", Name: "web", Port: 80, Tags: []string{"http"}}
+var webTLS = registry.Container{ID: "container1", Name: "web", Port: 443}
+var redis = registry.Container{ID: "container2", Name: "redis", Port: 6379}
+
+func TestContainerRepositoryReturnsEntriesOfRunningContainers(t *testing.T) {
+	repository := NewContainerRepository(web, webTLS)
+	repository.Add(redis)
+
+	containers, err := repository.GetAll(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []registry.Container{web, webTLS, redis}, containers)
+
+	containers, err = repository.Get(context.Background(), "container1")
+	assert.Nil(t, err)
+	assert.Equal(t, []registry.Container{web, webTLS}, containers)
+
+	repository.Remove("container1")
+	containers, err = repository.Get(context.Background(), "container1")
+	assert.Nil(t, err)
+	assert.Equal(t, []registry.Container{}, containers)
+	assert.Equal(t, 2, repository.Calls(GetCall))
+}
+
+func TestContainerRepositoryReturnsCopies(t *testing.T) {
+	repository := NewContainerRepository(web)
+
+	containers, _ := repository.GetAll(context.Background())
+	containers[0].Tags[0] = "changed"
+
+	containers, _ = repository.GetAll(context.Background())
+	assert.Equal(t, []string{"http"}, containers[0].Tags)
+}
+
+func TestServiceRepositoryRegistersAndDeregistersServices(t *testing.T) {
+	redis := &registry.Service{ID: "host1:container2:6379", Service: "redis", Port: 6379}
+	web := &registry.Service{ID: "host1:container1:80", Service: "web", Port: 80}
+	repository := NewServiceRepository(redis)
+
+	assert.Nil(t, repository.Register(context.Background(), web))
+	services, err := repository.GetAll(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []*registry.Service{web, redis}, services)
+
+	assert.Nil(t, repository.Deregister(context.Background(), redis.ID))
+	assert.Nil(t, repository.Deregister(context.Background(), "host1:unknown:22"))
+	assert.Equal(t, []*registry.Service{web}, repository.Services())
+	assert.Equal(t, 1, repository.Calls(GetAllCall))
+}
+
+func TestThatNthCallFails(t *testing.T) {
+	repository := NewServiceRepository()
+	expectedError := errors.New("consul unavailable")
+	repository.FailNth(GetAllCall, 2, expectedError)
+
+	_, err := repository.GetAll(context.Background())
+	assert.Nil(t, err)
+	_, err = repository.GetAll(context.Background())
+	assert.Equal(t, expectedError, err)
+	_, err = repository.GetAll(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, repository.Calls(GetAllCall))
+}
+
+func TestThatCallsOfFailedIDFailUntilFaultsAreCleared(t *testing.T) {
+	web := &registry.Service{ID: "host1:container1:80", Service: "web", Port: 80}
+	redis := &registry.Service{ID: "host1:container2:6379", Service: "redis", Port: 6379}
+	repository := NewServiceRepository()
+	expectedError := errors.New("permission denied")
+	repository.FailID(web.ID, expectedError)
+
+	assert.Equal(t, expectedError, repository.Register(context.Background(), web))
+	assert.Nil(t, repository.Register(context.Background(), redis))
+	assert.Equal(t, []*registry.Service{redis}, repository.Services())
+
+	repository.ClearFaults()
+	assert.Nil(t, repository.Register(context.Background(), web))
+	assert.Len(t, repository.Services(), 2)
+}
+
+func TestThatLatencyIsInterruptedByContext(t *testing.T) {
+	repository := NewContainerRepository(web)
+	repository.SetLatency(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := repository.GetAll(ctx)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestThatLatencyDelaysCalls(t *testing.T) {
+	repository := NewContainerRepository(web)
+	repository.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+
+	containers, err := repository.Get(context.Background(), "container1")
+
+	assert.Nil(t, err)
+	assert.Len(t, containers, 1)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
+
+func TestServiceRepositoryIsSafeForConcurrentUse(t *testing.T) {
+	repository := NewServiceRepository()
+	var wait sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			service := &registry.Service{ID: fmt.Sprintf("host1:container%d:80", i), Service: "web", Port: 80}
+			repository.Register(context.Background(), service)
+			repository.GetAll(context.Background())
+			if i%2 == 0 {
+				repository.Deregister(context.Background(), service.ID)
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	assert.Len(t, repository.Services(), 25)
+	assert.Equal(t, 50, repository.Calls(RegisterCall))
+}
@@ -1,84 +1,394 @@
 package registry
 
+import (
+	"context"
+	"fmt"
+	"github.com/alaa/pencil-go/metrics"
+	"strings"
+	"time"
+)
+
 // Registry understands how to synchronize registered Services with running Containers
 type Registry struct {
 	containerRepository ContainerRepository
 	serviceRepository   ServiceRepository
+	hostname            string
 }
 
-// NewRegistry creates new instance of Registry
-func NewRegistry(containerRepository ContainerRepository, serviceRepository ServiceRepository) *Registry {
+// NewRegistry creates new instance of Registry, hostname becomes part of registered services IDs
+func NewRegistry(containerRepository ContainerRepository, serviceRepository ServiceRepository, hostname string) *Registry {
 	return &Registry{
 		containerRepository,
 		serviceRepository,
+		hostname,
 	}
 }
 
-// Synchronize synchronizes registered services according to running containers
-func (r *Registry) Synchronize() error {
-	registeredServicesIDs := r.serviceRepository.GetAllIds()
-	runningContainers, err := r.containerRepository.GetAll()
+// Synchronize synchronizes registered services according to running containers,
+// it stops before the next register or deregister call when ctx is done.
+// Failures of single services are returned as SyncError and listed in the report.
+func (r *Registry) Synchronize(ctx context.Context) (*Report, error) {
+	start := time.Now()
+	report, err := r.synchronize(ctx)
+	metrics.SyncDuration.Observe(time.Since(start).Seconds())
+	if err == nil {
+		metrics.LastSuccessfulSync.SetToCurrentTime()
+	}
+	return report, err
+}
 
+func (r *Registry) synchronize(ctx context.Context) (*Report, error) {
+	report := newReport()
+	var runningContainers []Container
+	err := r.eachBackend(func(backend Backend) error {
+		registeredServices, err := backend.Repository.GetAll(ctx)
+		if err != nil {
+			return err
+		}
+		// containers are listed once and shared by all backends
+		if runningContainers == nil {
+			if runningContainers, err = r.runningContainers(ctx); err != nil {
+				return err
+			}
+		}
+		plan, err := r.fullPlan(ctx, backend, registeredServices, runningContainers)
+		if err != nil {
+			return err
+		}
+		return r.apply(ctx, report, backend, plan)
+	})
+	return report, err
+}
+
+// fullPlan computes changes of full synchronization of backend, it is shared by Synchronize and Plan
+// so planned changes are the ones synchronization applies
+func (r *Registry) fullPlan(ctx context.Context, backend Backend, registeredServices []*Service, runningContainers []Container) (*Plan, error) {
+	plan := r.plan(backend, registeredServices, registeredServices, runningContainers)
+	if err := r.planForeignServices(ctx, backend, plan, registeredServices, runningContainers); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// planForeignServices updates running services attached to another lease or session of leased repository,
+// so they are kept when it ends
+func (r *Registry) planForeignServices(ctx context.Context, backend Backend, plan *Plan, registeredServices []*Service, runningContainers []Container) error {
+	leased, ok := backend.Repository.(LeasedServiceRepository)
+	if !ok {
+		return nil
+	}
+	foreignIDs, err := leased.ForeignServices(ctx)
 	if err != nil {
 		return err
 	}
+	foreign := map[string]bool{}
+	for _, serviceID := range foreignIDs {
+		foreign[serviceID] = true
+	}
+	for _, planned := range plan.Update {
+		delete(foreign, planned.ID)
+	}
+	registeredServicesMap := r.servicesMap(registeredServices)
+	for _, container := range runningContainers {
+		service := r.containerToService(&container)
+		if _, ok := registeredServicesMap[service.ID]; ok && foreign[service.ID] {
+			plan.Update = append(plan.Update, PlannedService{service, backend.Name})
+		}
+	}
+	return nil
+}
 
-	r.registerServices(registeredServicesIDs, runningContainers)
-	r.deregisterServices(registeredServicesIDs, runningContainers)
+// Plan computes changes which synchronization would apply without applying them,
+// changes of backends of composite repository are listed one after another
+func (r *Registry) Plan(ctx context.Context) (*Plan, error) {
+	plan := &Plan{Register: []PlannedService{}, Update: []PlannedService{}, Deregister: []ServiceChange{}}
+	var runningContainers []Container
+	err := r.eachBackend(func(backend Backend) error {
+		registeredServices, err := backend.Repository.GetAll(ctx)
+		if err != nil {
+			return err
+		}
+		if runningContainers == nil {
+			if runningContainers, err = r.runningContainers(ctx); err != nil {
+				return err
+			}
+		}
+		backendPlan, err := r.fullPlan(ctx, backend, registeredServices, runningContainers)
+		if err != nil {
+			return err
+		}
+		plan.Register = append(plan.Register, backendPlan.Register...)
+		plan.Update = append(plan.Update, backendPlan.Update...)
+		plan.Deregister = append(plan.Deregister, backendPlan.Deregister...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
 
+// DesiredServices returns services which should be registered for running containers
+func (r *Registry) DesiredServices(ctx context.Context) ([]*Service, error) {
+	runningContainers, err := r.containerRepository.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	services := []*Service{}
+	for _, container := range runningContainers {
+		services = append(services, r.containerToService(&container))
+	}
+	return services, nil
+}
+
+// SynchronizeContainer synchronizes registered services of single container
+func (r *Registry) SynchronizeContainer(ctx context.Context, containerID string) (*Report, error) {
+	report := newReport()
+	var containers []Container
+	err := r.eachBackend(func(backend Backend) error {
+		registeredServices, err := backend.Repository.GetAll(ctx)
+		if err != nil {
+			return err
+		}
+		if containers == nil {
+			if containers, err = r.containerRepository.Get(ctx, containerID); err != nil {
+				return err
+			}
+		}
+		return r.apply(ctx, report, backend, r.plan(backend, registeredServices, r.containerServices(registeredServices, containerID), containers))
+	})
+	return report, err
+}
+
+// DeregisterAll removes all registered services, e.g. when pencil is shutting down
+func (r *Registry) DeregisterAll(ctx context.Context) (*Report, error) {
+	report := newReport()
+	err := r.eachBackend(func(backend Backend) error {
+		registeredServices, err := backend.Repository.GetAll(ctx)
+		if err != nil {
+			return err
+		}
+		return r.apply(ctx, report, backend, r.plan(backend, registeredServices, registeredServices, []Container{}))
+	})
+	return report, err
+}
+
+// eachBackend runs step with every backend of composite service repository, so each backend is diffed
+// against containers independently and a failing backend does not stop the others.
+// Plain service repository is the only backend and its error is returned as it is.
+func (r *Registry) eachBackend(step func(backend Backend) error) error {
+	if composite, ok := r.serviceRepository.(*CompositeServiceRepository); ok {
+		return composite.each(step)
+	}
+	return step(Backend{Repository: r.serviceRepository})
+}
+
+func (r *Registry) runningContainers(ctx context.Context) ([]Container, error) {
+	runningContainers, err := r.containerRepository.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metrics.ContainersSeen.Set(float64(len(runningContainers)))
+	return runningContainers, nil
+}
+
+// plan deregisters only services from the removable set, so single container sync leaves other services intact
+func (r *Registry) plan(backend Backend, registeredServices []*Service, removableServices []*Service, runningContainers []Container) *Plan {
+	plan := &Plan{Register: []PlannedService{}, Update: []PlannedService{}, Deregister: []ServiceChange{}}
+	for _, service := range r.servicesToRegister(registeredServices, runningContainers) {
+		plan.Register = append(plan.Register, PlannedService{service, backend.Name})
+	}
+	for _, service := range r.servicesToUpdate(registeredServices, runningContainers) {
+		plan.Update = append(plan.Update, PlannedService{service, backend.Name})
+	}
+	for _, serviceID := range r.servicesIDsToDeregister(removableServices, runningContainers) {
+		plan.Deregister = append(plan.Deregister, ServiceChange{serviceID, backend.Name})
+	}
+	return plan
+}
+
+// apply adds changes made in backend to the report, it returns SyncError with failures of the backend only
+func (r *Registry) apply(ctx context.Context, report *Report, backend Backend, plan *Plan) error {
+	failed := len(report.Failed)
+	if err := r.registerServices(ctx, report, backend, plan.Register); err != nil {
+		return err
+	}
+	if err := r.updateServices(ctx, report, backend, plan.Update); err != nil {
+		return err
+	}
+	if err := r.deregisterServices(ctx, report, backend, plan.Deregister); err != nil {
+		return err
+	}
+	if len(report.Failed) > failed {
+		return &SyncError{Errors: report.Failed[failed:]}
+	}
+	return nil
+}
+
+func (r *Registry) registerServices(ctx context.Context, report *Report, backend Backend, services []PlannedService) error {
+	for _, service := range services {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := backend.Repository.Register(ctx, service.Service); err != nil {
+			report.Failed = append(report.Failed, &ServiceError{service.ID, "register", err, backend.Name})
+		} else {
+			report.Registered = append(report.Registered, ServiceChange{service.ID, backend.Name})
+			metrics.ServicesRegistered.Inc()
+		}
+	}
 	return nil
 }
 
-func (r *Registry) registerServices(registeredServicesIDs []string, runningContainers []Container) {
-	for _, service := range r.servicesToRegister(registeredServicesIDs, runningContainers) {
-		r.serviceRepository.Register(service)
+// updateServices re-registers services which definition differs from the registered one
+func (r *Registry) updateServices(ctx context.Context, report *Report, backend Backend, services []PlannedService) error {
+	for _, service := range services {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := backend.Repository.Register(ctx, service.Service); err != nil {
+			report.Failed = append(report.Failed, &ServiceError{service.ID, "update", err, backend.Name})
+		} else {
+			report.Updated = append(report.Updated, ServiceChange{service.ID, backend.Name})
+			metrics.ServicesRegistered.Inc()
+		}
 	}
+	return nil
 }
 
-func (r *Registry) deregisterServices(registeredServicesIDs []string, runningContainers []Container) {
-	for _, serviceID := range r.servicesIDsToDeregister(registeredServicesIDs, runningContainers) {
-		r.serviceRepository.Deregister(serviceID)
+func (r *Registry) deregisterServices(ctx context.Context, report *Report, backend Backend, services []ServiceChange) error {
+	for _, service := range services {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := backend.Repository.Deregister(ctx, service.ServiceID); err != nil {
+			report.Failed = append(report.Failed, &ServiceError{service.ServiceID, "deregister", err, backend.Name})
+		} else {
+			report.Deregistered = append(report.Deregistered, ServiceChange{service.ServiceID, backend.Name})
+			metrics.ServicesDeregistered.Inc()
+		}
 	}
+	return nil
 }
 
-func (r *Registry) servicesToRegister(registeredServicesIDs []string, runningContainers []Container) []*Service {
+func (r *Registry) servicesToRegister(registeredServices []*Service, runningContainers []Container) []*Service {
 	servicesToRegister := []*Service{}
-	registeredServicesIDsMap := r.sliceToMap(registeredServicesIDs)
+	registeredServicesMap := r.servicesMap(registeredServices)
 	for _, container := range runningContainers {
-		if _, ok := registeredServicesIDsMap[container.ID]; !ok {
-			servicesToRegister = append(servicesToRegister, containerToService(&container))
+		if _, ok := registeredServicesMap[r.serviceID(&container)]; !ok {
+			servicesToRegister = append(servicesToRegister, r.containerToService(&container))
 		}
 	}
 	return servicesToRegister
 }
 
-func (r *Registry) servicesIDsToDeregister(registeredServicesIDs []string, runningContainers []Container) []string {
+func (r *Registry) servicesToUpdate(registeredServices []*Service, runningContainers []Container) []*Service {
+	servicesToUpdate := []*Service{}
+	registeredServicesMap := r.servicesMap(registeredServices)
+	for _, container := range runningContainers {
+		service := r.containerToService(&container)
+		if registered, ok := registeredServicesMap[service.ID]; ok && !servicesEqual(registered, service) {
+			servicesToUpdate = append(servicesToUpdate, service)
+		}
+	}
+	return servicesToUpdate
+}
+
+func (r *Registry) servicesIDsToDeregister(registeredServices []*Service, runningContainers []Container) []string {
 	servicesIdsToDeregister := []string{}
-	runningContainersIDsSet := r.containersIDsMap(runningContainers)
-	for _, serviceID := range registeredServicesIDs {
-		if _, ok := runningContainersIDsSet[serviceID]; !ok {
-			servicesIdsToDeregister = append(servicesIdsToDeregister, serviceID)
+	runningServicesIDsSet := r.servicesIDsMap(runningContainers)
+	for _, service := range registeredServices {
+		if _, ok := runningServicesIDsSet[service.ID]; !ok {
+			servicesIdsToDeregister = append(servicesIdsToDeregister, service.ID)
 		}
 	}
 	return servicesIdsToDeregister
 }
 
-func containerToService(container *Container) *Service {
-	return &Service{ID: container.ID, Service: container.Name, Port: container.Port, Tags: container.Tags}
+func (r *Registry) containerServices(services []*Service, containerID string) []*Service {
+	containerServices := []*Service{}
+	for _, service := range services {
+		if serviceContainerID(service.ID) == containerID {
+			containerServices = append(containerServices, service)
+		}
+	}
+	return containerServices
 }
 
-func (r *Registry) sliceToMap(slice []string) map[string]bool {
-	result := map[string]bool{}
-	for _, item := range slice {
-		result[item] = true
+func (r *Registry) containerToService(container *Container) *Service {
+	return &Service{
+		ID:      r.serviceID(container),
+		Service: container.Name,
+		Address: container.Address,
+		Port:    container.Port,
+		Tags:    container.Tags,
+		Meta:    container.Meta,
+		Check:   container.Check,
+	}
+}
+
+func (r *Registry) servicesMap(services []*Service) map[string]*Service {
+	result := map[string]*Service{}
+	for _, service := range services {
+		result[service.ID] = service
 	}
 	return result
 }
 
-func (r *Registry) containersIDsMap(containers []Container) map[string]bool {
+func (r *Registry) servicesIDsMap(containers []Container) map[string]bool {
 	result := map[string]bool{}
 	for _, container := range containers {
-		result[container.ID] = true
+		result[r.serviceID(&container)] = true
 	}
 	return result
 }
+
+// serviceID identifies service by host, container and port, e.g. "hostname:container:8000"
+func (r *Registry) serviceID(container *Container) string {
+	return fmt.Sprintf("%s:%s:%d", r.hostname, container.ID, container.Port)
+}
+
+// serviceContainerID extracts container ID from service ID, returns empty string for foreign IDs
+func serviceContainerID(serviceID string) string {
+	parts := strings.Split(serviceID, ":")
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+func servicesEqual(a, b *Service) bool {
+	return a.ID == b.ID &&
+		a.Service == b.Service &&
+		a.Address == b.Address &&
+		a.Port == b.Port &&
+		a.Check == b.Check &&
+		stringsEqual(a.Tags, b.Tags) &&
+		metaEqual(a.Meta, b.Meta)
+}
+
+// metaEqual treats nil and empty maps as equal
+func metaEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, exist := b[key]; !exist || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// stringsEqual treats nil and empty slices as equal
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,26 +1,30 @@
 package registry
 
 import (
+	"context"
 	"errors"
+	"github.com/alaa/pencil-go/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"testing"
+	"time"
 )
 
 func TestSynchronizeWhenNoServicesWereRegisteredBefore(t *testing.T) {
 	serviceRepository := new(MockServiceRepository)
 	containerRepository := new(MockContainerRepository)
-	registry := NewRegistry(containerRepository, serviceRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
 
-	serviceRepository.On("GetAllIds").Return([]string{})
+	serviceRepository.On("GetAll").Return([]*Service{}, nil)
 	serviceRepository.On("Register", &Service{
-		ID:      "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+		ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
 		Service: "/elated_kirch",
 		Port:    22,
 		Tags:    []string{},
 	}).Return(nil)
 	serviceRepository.On("Register", &Service{
-		ID:      "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db",
+		ID:      "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000",
 		Service: "/naughty_heisenberg",
 		Port:    9000,
 		Tags:    []string{"tag1", "tag2"},
@@ -44,7 +48,7 @@ func TestSynchronizeWhenNoServicesWereRegisteredBefore(t *testing.T) {
 		nil,
 	)
 
-	registry.Synchronize()
+	registry.Synchronize(context.Background())
 
 	serviceRepository.AssertExpectations(t)
 	containerRepository.AssertExpectations(t)
@@ -53,12 +57,22 @@ func TestSynchronizeWhenNoServicesWereRegisteredBefore(t *testing.T) {
 func TestSynchronieWhenAllServicesWereRegisteredBefore(t *testing.T) {
 	serviceRepository := new(MockServiceRepository)
 	containerRepository := new(MockContainerRepository)
-	registry := NewRegistry(containerRepository, serviceRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
 
-	serviceRepository.On("GetAllIds").Return([]string{
-		"bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
-		"f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db",
-	})
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/elated_kirch",
+			Port:    22,
+			Tags:    []string{},
+		},
+		&Service{
+			ID:      "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000",
+			Service: "/naughty_heisenberg",
+			Port:    9000,
+			Tags:    []string{"tag1", "tag2"},
+		},
+	}, nil)
 	containerRepository.AssertNotCalled(t, "Register")
 
 	containerRepository.On("GetAll").Return(
@@ -79,7 +93,7 @@ func TestSynchronieWhenAllServicesWereRegisteredBefore(t *testing.T) {
 		nil,
 	)
 
-	registry.Synchronize()
+	registry.Synchronize(context.Background())
 
 	serviceRepository.AssertExpectations(t)
 	containerRepository.AssertExpectations(t)
@@ -88,12 +102,22 @@ func TestSynchronieWhenAllServicesWereRegisteredBefore(t *testing.T) {
 func TestSynchronieWhenOneServiceIsMissingAndOneIsRedundant(t *testing.T) {
 	serviceRepository := new(MockServiceRepository)
 	containerRepository := new(MockContainerRepository)
-	registry := NewRegistry(containerRepository, serviceRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
 
-	serviceRepository.On("GetAllIds").Return([]string{
-		"bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
-		"0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
-	})
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/elated_kirch",
+			Port:    22,
+			Tags:    []string{},
+		},
+		&Service{
+			ID:      "host1:0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/stopped_container",
+			Port:    22,
+			Tags:    []string{},
+		},
+	}, nil)
 	containerRepository.AssertNotCalled(t, "Register")
 
 	containerRepository.On("GetAll").Return(
@@ -115,35 +139,344 @@ func TestSynchronieWhenOneServiceIsMissingAndOneIsRedundant(t *testing.T) {
 	)
 
 	serviceRepository.On("Register", &Service{
-		ID:      "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db",
+		ID:      "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000",
 		Service: "/naughty_heisenberg",
 		Port:    9000,
 		Tags:    []string{"tag1", "tag2"},
 	}).Return(nil)
-	serviceRepository.On("Deregister", "0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9").Return(nil)
+	serviceRepository.On("Deregister", "host1:0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22").Return(nil)
+
+	registry.Synchronize(context.Background())
+
+	serviceRepository.AssertExpectations(t)
+	containerRepository.AssertExpectations(t)
+}
+
+func TestSynchronizeRegistersEachPortOfContainerAsSeparateService(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "eve-landing-pages",
+			Port:    22,
+			Tags:    []string{},
+		},
+	}, nil)
+	containerRepository.On("GetAll").Return(
+		[]Container{
+			Container{
+				ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+				Name: "eve-landing-pages",
+				Port: 22,
+				Tags: []string{},
+			},
+			Container{
+				ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+				Name: "eve-landing-pages",
+				Port: 8000,
+				Tags: []string{},
+			},
+		},
+		nil,
+	)
+	serviceRepository.On("Register", &Service{
+		ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:8000",
+		Service: "eve-landing-pages",
+		Port:    8000,
+		Tags:    []string{},
+	}).Return(nil)
 
-	registry.Synchronize()
+	registry.Synchronize(context.Background())
 
 	serviceRepository.AssertExpectations(t)
+	serviceRepository.AssertNumberOfCalls(t, "Register", 1)
+	serviceRepository.AssertNotCalled(t, "Deregister", mock.Anything)
+	containerRepository.AssertExpectations(t)
+}
+
+func TestSynchronizeReregistersServicesWhichDefinitionChanged(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/elated_kirch",
+			Port:    22,
+		},
+		&Service{
+			ID:      "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000",
+			Service: "/naughty_heisenberg",
+			Port:    9000,
+			Tags:    []string{"tag1"},
+		},
+	}, nil)
+	containerRepository.On("GetAll").Return(
+		[]Container{
+			Container{
+				ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+				Name: "/elated_kirch",
+				Port: 22,
+				Tags: []string{},
+			},
+			Container{
+				ID:    "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db",
+				Name:  "/naughty_heisenberg",
+				Port:  9000,
+				Tags:  []string{"tag1", "tag2"},
+				Check: ServiceCheck{HTTP: "/health"},
+			},
+		},
+		nil,
+	)
+	serviceRepository.On("Register", &Service{
+		ID:      "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000",
+		Service: "/naughty_heisenberg",
+		Port:    9000,
+		Tags:    []string{"tag1", "tag2"},
+		Check:   ServiceCheck{HTTP: "/health"},
+	}).Return(nil)
+
+	registry.Synchronize(context.Background())
+
+	serviceRepository.AssertExpectations(t)
+	serviceRepository.AssertNumberOfCalls(t, "Register", 1)
+	serviceRepository.AssertNotCalled(t, "Deregister", mock.Anything)
 	containerRepository.AssertExpectations(t)
 }
 
 func TestLogErrorIfFetchingContainersFailed(t *testing.T) {
 	serviceRepository := new(MockServiceRepository)
 	containerRepository := new(MockContainerRepository)
-	registry := NewRegistry(containerRepository, serviceRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
 
-	serviceRepository.On("GetAllIds").Return([]string{
-		"bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
-		"0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
-	})
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/elated_kirch",
+			Port:    22,
+			Tags:    []string{},
+		},
+		&Service{
+			ID:      "host1:0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/stopped_container",
+			Port:    22,
+			Tags:    []string{},
+		},
+	}, nil)
 
 	expectedError := errors.New("foo")
 	containerRepository.On("GetAll").Return([]Container{}, expectedError)
 
-	err := registry.Synchronize()
+	_, err := registry.Synchronize(context.Background())
+
+	assert.Equal(t, expectedError, err)
+}
+
+func TestSynchronizeContainerRegistersServicesOfStartedContainer(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/elated_kirch",
+			Port:    22,
+			Tags:    []string{},
+		},
+	}, nil)
+	containerRepository.On("Get", "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db").Return(
+		[]Container{
+			Container{
+				ID:   "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db",
+				Name: "/naughty_heisenberg",
+				Port: 9000,
+				Tags: []string{"tag1", "tag2"},
+			},
+		},
+		nil,
+	)
+	serviceRepository.On("Register", &Service{
+		ID:      "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000",
+		Service: "/naughty_heisenberg",
+		Port:    9000,
+		Tags:    []string{"tag1", "tag2"},
+	}).Return(nil)
+
+	_, err := registry.SynchronizeContainer(context.Background(), "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db")
+
+	assert.Nil(t, err)
+	serviceRepository.AssertExpectations(t)
+	containerRepository.AssertExpectations(t)
+}
+
+func TestSynchronizeContainerDeregistersOnlyServicesOfStoppedContainer(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/elated_kirch",
+			Port:    22,
+			Tags:    []string{},
+		},
+		&Service{
+			ID:      "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000",
+			Service: "/naughty_heisenberg",
+			Port:    9000,
+			Tags:    []string{"tag1", "tag2"},
+		},
+	}, nil)
+	containerRepository.On("Get", "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db").Return([]Container{}, nil)
+	serviceRepository.On("Deregister", "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000").Return(nil)
+
+	_, err := registry.SynchronizeContainer(context.Background(), "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db")
+
+	assert.Nil(t, err)
+	serviceRepository.AssertExpectations(t)
+	serviceRepository.AssertNotCalled(t, "Deregister", "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22")
+	containerRepository.AssertExpectations(t)
+}
+
+func TestSynchronizeStopsWhenContextIsCanceled(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/stopped_container",
+			Port:    22,
+		},
+	}, nil)
+	containerRepository.On("GetAll").Return(
+		[]Container{
+			Container{
+				ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+				Name: "eve-landing-pages",
+				Port: 22,
+				Tags: []string{},
+			},
+			Container{
+				ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+				Name: "eve-landing-pages",
+				Port: 8000,
+				Tags: []string{},
+			},
+		},
+		nil,
+	)
+	serviceRepository.On("Register", mock.Anything).Return(nil).Run(func(mock.Arguments) {
+		cancel()
+	})
+
+	_, err := registry.Synchronize(ctx)
+
+	assert.Equal(t, context.Canceled, err)
+	serviceRepository.AssertNumberOfCalls(t, "Register", 1)
+	serviceRepository.AssertNotCalled(t, "Deregister", mock.Anything)
+}
+
+func TestDeregisterAllRemovesEveryRegisteredService(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{ID: "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22"},
+		&Service{ID: "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000"},
+	}, nil)
+	serviceRepository.On("Deregister", "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22").Return(nil)
+	serviceRepository.On("Deregister", "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000").Return(nil)
+
+	_, err := registry.DeregisterAll(context.Background())
+
+	assert.Nil(t, err)
+	serviceRepository.AssertExpectations(t)
+	containerRepository.AssertNotCalled(t, "GetAll")
+}
+
+func TestSynchronizeReportsFailedServicesAndContinues(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+	registerError := errors.New("consul unavailable")
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/stopped_container",
+			Port:    22,
+		},
+	}, nil)
+	containerRepository.On("GetAll").Return(
+		[]Container{
+			Container{
+				ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+				Name: "/elated_kirch",
+				Port: 22,
+				Tags: []string{},
+			},
+			Container{
+				ID:   "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db",
+				Name: "/naughty_heisenberg",
+				Port: 9000,
+				Tags: []string{"tag1", "tag2"},
+			},
+		},
+		nil,
+	)
+	serviceRepository.On("Register", &Service{
+		ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+		Service: "/elated_kirch",
+		Port:    22,
+		Tags:    []string{},
+	}).Return(registerError)
+	serviceRepository.On("Register", &Service{
+		ID:      "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000",
+		Service: "/naughty_heisenberg",
+		Port:    9000,
+		Tags:    []string{"tag1", "tag2"},
+	}).Return(nil)
+	serviceRepository.On("Deregister", "host1:0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22").Return(nil)
+
+	report, err := registry.Synchronize(context.Background())
+
+	failure := &ServiceError{ServiceID: "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22", Operation: "register", Err: registerError}
+	assert.Equal(t, &SyncError{Errors: []*ServiceError{failure}}, err)
+	assert.Equal(t, &Report{
+		Registered:   []ServiceChange{{ServiceID: "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000"}},
+		Updated:      []ServiceChange{},
+		Deregistered: []ServiceChange{{ServiceID: "host1:0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22"}},
+		Failed:       []*ServiceError{failure},
+	}, report)
+	assert.Equal(t, "1 services failed to synchronize: register host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22: consul unavailable", err.Error())
+	serviceRepository.AssertExpectations(t)
+}
+
+func TestSynchronizeFailsWhenRegisteredServicesCannotBeFetched(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+	expectedError := errors.New("consul unavailable")
+
+	serviceRepository.On("GetAll").Return([]*Service{}, expectedError)
+
+	report, err := registry.Synchronize(context.Background())
 
 	assert.Equal(t, expectedError, err)
+	assert.False(t, report.Changed())
+	serviceRepository.AssertNotCalled(t, "Deregister", mock.Anything)
+	containerRepository.AssertNotCalled(t, "GetAll")
 }
 
 type MockServiceRepository struct {
@@ -154,22 +487,230 @@ type MockContainerRepository struct {
 	mock.Mock
 }
 
-func (msr *MockServiceRepository) GetAllIds() []string {
+func (msr *MockServiceRepository) GetAll(ctx context.Context) ([]*Service, error) {
 	args := msr.Called()
-	return args.Get(0).([]string)
+	return args.Get(0).([]*Service), args.Error(1)
 
 }
-func (msr *MockServiceRepository) Register(service *Service) error {
+func (msr *MockServiceRepository) Register(ctx context.Context, service *Service) error {
 	args := msr.Called(service)
 	return args.Error(0)
 }
 
-func (msr *MockServiceRepository) Deregister(serviceID string) error {
+func (msr *MockServiceRepository) Deregister(ctx context.Context, serviceID string) error {
 	args := msr.Called(serviceID)
 	return args.Error(0)
 }
 
-func (mcr *MockContainerRepository) GetAll() ([]Container, error) {
+type MockLeasedServiceRepository struct {
+	MockServiceRepository
+}
+
+func (mlsr *MockLeasedServiceRepository) ForeignServices(ctx context.Context) ([]string, error) {
+	args := mlsr.Called()
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (mcr *MockContainerRepository) GetAll(ctx context.Context) ([]Container, error) {
 	args := mcr.Called()
 	return args.Get(0).([]Container), args.Error(1)
 }
+
+func (mcr *MockContainerRepository) Get(ctx context.Context, containerID string) ([]Container, error) {
+	args := mcr.Called(containerID)
+	return args.Get(0).([]Container), args.Error(1)
+}
+
+func TestSynchronizeRecordsMetrics(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+	registeredBefore := testutil.ToFloat64(metrics.ServicesRegistered)
+	deregisteredBefore := testutil.ToFloat64(metrics.ServicesDeregistered)
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/stopped_container",
+			Port:    22,
+		},
+	}, nil)
+	containerRepository.On("GetAll").Return([]Container{
+		Container{
+			ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+			Name: "/elated_kirch",
+			Port: 22,
+			Tags: []string{},
+		},
+	}, nil)
+	serviceRepository.On("Register", mock.Anything).Return(nil)
+	serviceRepository.On("Deregister", mock.Anything).Return(nil)
+
+	_, err := registry.Synchronize(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, registeredBefore+1, testutil.ToFloat64(metrics.ServicesRegistered))
+	assert.Equal(t, deregisteredBefore+1, testutil.ToFloat64(metrics.ServicesDeregistered))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.ContainersSeen))
+	assert.InDelta(t, float64(time.Now().Unix()), testutil.ToFloat64(metrics.LastSuccessfulSync), 5)
+}
+
+func TestPlanListsChangesWithoutApplyingThem(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/stopped_container",
+			Port:    22,
+		},
+	}, nil)
+	containerRepository.On("GetAll").Return([]Container{
+		Container{
+			ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+			Name: "/elated_kirch",
+			Port: 22,
+			Tags: []string{},
+		},
+	}, nil)
+
+	plan, err := registry.Plan(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, &Plan{
+		Register: []PlannedService{
+			{Service: &Service{
+				ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+				Service: "/elated_kirch",
+				Port:    22,
+				Tags:    []string{},
+			}},
+		},
+		Update:     []PlannedService{},
+		Deregister: []ServiceChange{{ServiceID: "host1:0g1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22"}},
+	}, plan)
+	serviceRepository.AssertNotCalled(t, "Register", mock.Anything)
+	serviceRepository.AssertNotCalled(t, "Deregister", mock.Anything)
+}
+
+func TestDesiredServicesAreBuiltFromRunningContainers(t *testing.T) {
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, new(MockServiceRepository), "host1")
+
+	containerRepository.On("GetAll").Return([]Container{
+		Container{
+			ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+			Name: "/elated_kirch",
+			Port: 22,
+			Tags: []string{"tag1"},
+		},
+	}, nil)
+
+	services, err := registry.DesiredServices(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*Service{
+		&Service{
+			ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/elated_kirch",
+			Port:    22,
+			Tags:    []string{"tag1"},
+		},
+	}, services)
+}
+
+func TestSynchronizeUpdatesServicesWhichMetadataChanged(t *testing.T) {
+	serviceRepository := new(MockServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{
+			ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+			Service: "/elated_kirch",
+			Port:    22,
+			Meta:    map[string]string{"version": "1.1"},
+		},
+		&Service{
+			ID:      "host1:f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db:9000",
+			Service: "/naughty_heisenberg",
+			Port:    9000,
+			Meta:    map[string]string{},
+		},
+	}, nil)
+	containerRepository.On("GetAll").Return([]Container{
+		Container{
+			ID:   "bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9",
+			Name: "/elated_kirch",
+			Port: 22,
+			Meta: map[string]string{"version": "1.2"},
+		},
+		Container{
+			ID:   "f717f795bcccd674628b92f77a72f4b80b2c6b5da289846a0edbd21fb4c462db",
+			Name: "/naughty_heisenberg",
+			Port: 9000,
+		},
+	}, nil)
+	serviceRepository.On("Register", &Service{
+		ID:      "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22",
+		Service: "/elated_kirch",
+		Port:    22,
+		Meta:    map[string]string{"version": "1.2"},
+	}).Return(nil)
+
+	report, err := registry.Synchronize(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []ServiceChange{{ServiceID: "host1:bd1d34c0ebeeb62dfdcc57327aca15d2ef3cbc39a60e44aecb7085a8d1f89fd9:22"}}, report.Updated)
+	serviceRepository.AssertExpectations(t)
+}
+
+func TestSynchronizeRegistersAgainServicesOfAnotherLease(t *testing.T) {
+	serviceRepository := new(MockLeasedServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{ID: "host1:container1:22", Service: "/elated_kirch", Port: 22},
+		&Service{ID: "host1:container2:9000", Service: "/naughty_heisenberg", Port: 9000},
+		&Service{ID: "host1:container3:80", Service: "/stopped", Port: 80},
+	}, nil)
+	serviceRepository.On("ForeignServices").Return([]string{"host1:container1:22", "host1:container3:80"}, nil)
+	containerRepository.On("GetAll").Return([]Container{
+		Container{ID: "container1", Name: "/elated_kirch", Port: 22},
+		Container{ID: "container2", Name: "/naughty_heisenberg", Port: 9000},
+	}, nil)
+	serviceRepository.On("Register", &Service{ID: "host1:container1:22", Service: "/elated_kirch", Port: 22}).Return(nil)
+	serviceRepository.On("Deregister", "host1:container3:80").Return(nil)
+
+	report, err := registry.Synchronize(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []ServiceChange{{ServiceID: "host1:container1:22"}}, report.Updated)
+	assert.Equal(t, []ServiceChange{{ServiceID: "host1:container3:80"}}, report.Deregistered)
+	serviceRepository.AssertExpectations(t)
+}
+
+func TestPlanListsServicesOfAnotherLeaseAsUpdates(t *testing.T) {
+	serviceRepository := new(MockLeasedServiceRepository)
+	containerRepository := new(MockContainerRepository)
+	registry := NewRegistry(containerRepository, serviceRepository, "host1")
+
+	serviceRepository.On("GetAll").Return([]*Service{
+		&Service{ID: "host1:container1:22", Service: "/elated_kirch", Port: 22},
+		&Service{ID: "host1:container2:9000", Service: "/naughty_heisenberg", Port: 9000},
+	}, nil)
+	serviceRepository.On("ForeignServices").Return([]string{"host1:container1:22"}, nil)
+	containerRepository.On("GetAll").Return([]Container{
+		Container{ID: "container1", Name: "/elated_kirch", Port: 22},
+		Container{ID: "container2", Name: "/naughty_heisenberg", Port: 9000},
+	}, nil)
+
+	plan, err := registry.Plan(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []PlannedService{{Service: &Service{ID: "host1:container1:22", Service: "/elated_kirch", Port: 22}}}, plan.Update)
+	serviceRepository.AssertNotCalled(t, "Register", mock.Anything)
+}
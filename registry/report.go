@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Report describes what single synchronization has done
+type Report struct {
+	Registered   []ServiceChange
+	Updated      []ServiceChange
+	Deregistered []ServiceChange
+	Failed       []*ServiceError
+}
+
+// ServiceChange identifies service and backend where it was or is going to be changed
+type ServiceChange struct {
+	ServiceID string
+	// Backend names backend of composite repository, it is empty otherwise
+	Backend string `json:",omitempty"`
+}
+
+func newReport() *Report {
+	return &Report{
+		Registered:   []ServiceChange{},
+		Updated:      []ServiceChange{},
+		Deregistered: []ServiceChange{},
+		Failed:       []*ServiceError{},
+	}
+}
+
+// Changed tells whether any service was touched
+func (r *Report) Changed() bool {
+	return len(r.Registered)+len(r.Updated)+len(r.Deregistered)+len(r.Failed) > 0
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("%d registered, %d updated, %d deregistered, %d failed",
+		len(r.Registered), len(r.Updated), len(r.Deregistered), len(r.Failed))
+}
+
+// Plan describes what synchronization is going to do
+type Plan struct {
+	Register   []PlannedService
+	Update     []PlannedService
+	Deregister []ServiceChange
+}
+
+// PlannedService is service going to be registered in backend
+type PlannedService struct {
+	*Service
+	// Backend names backend of composite repository, it is empty otherwise
+	Backend string `json:",omitempty"`
+}
+
+// ServiceError describes failed operation on single service
+type ServiceError struct {
+	ServiceID string
+	Operation string
+	Err       error
+	// Backend names backend of composite repository where the operation failed, it is empty otherwise
+	Backend string
+}
+
+func (e *ServiceError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Operation, e.ServiceID, e.Err)
+}
+
+// SyncError aggregates failures of single services, the rest of services is synchronized anyway
+type SyncError struct {
+	Errors []*ServiceError
+}
+
+func (e *SyncError) Error() string {
+	messages := []string{}
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d services failed to synchronize: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+// BackendError describes failed synchronization with single backend of composite repository
+type BackendError struct {
+	Backend string
+	Err     error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Backend, e.Err)
+}
+
+// BackendErrors aggregates failures of backends, the rest of backends is synchronized anyway
+type BackendErrors []*BackendError
+
+func (e BackendErrors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d backends failed to synchronize: %s", len(e), strings.Join(messages, "; "))
+}
@@ -1,23 +1,38 @@
 package registry
 
+import "context"
+
 // ContainerRepository is responsible for keeping Containers
 type ContainerRepository interface {
-	GetAll() ([]Container, error)
+	GetAll(ctx context.Context) ([]Container, error)
+	Get(ctx context.Context, containerID string) ([]Container, error)
 }
 
 // ServiceRepository is responsible for keeping Services
 type ServiceRepository interface {
-	GetAllIds() []string
-	Register(service *Service) error
-	Deregister(serviceID string) error
+	GetAll(ctx context.Context) ([]*Service, error)
+	Register(ctx context.Context, service *Service) error
+	Deregister(ctx context.Context, serviceID string) error
+}
+
+// LeasedServiceRepository is implemented by repositories keeping services attached to a lease or session,
+// which removes them when it ends. Synchronization registers services attached to another lease or session again,
+// e.g. services of previous pencil run or of the configuration before reload.
+type LeasedServiceRepository interface {
+	ServiceRepository
+	// ForeignServices returns IDs of services attached to another lease or session
+	ForeignServices(ctx context.Context) ([]string, error)
 }
 
 // Container entity
 type Container struct {
-	ID   string
-	Name string
-	Port int
-	Tags []string
+	ID      string
+	Name    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	Check   ServiceCheck
 }
 
 // Service entity
@@ -25,15 +40,20 @@ type Service struct {
 	ID      string
 	Service string
 	Tags    []string
+	Meta    map[string]string
 	Address string
 	Port    int
 	Check   ServiceCheck
 }
 
-// ServiceCheck describes details of service health check
+// ServiceCheck describes details of service health check.
+// HTTP holds either full URL or path requested on service address and port,
+// TCP holds either "host:port" or "true" to connect to service address and port.
 type ServiceCheck struct {
 	Script   string
 	HTTP     string
+	TCP      string
 	Interval string
+	Timeout  string
 	TTL      string
 }
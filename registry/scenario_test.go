@@ -0,0 +1,70 @@
+package registry_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/alaa/pencil-go/registry/memory"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSynchronizeRecoversFromPartialFailure(t *testing.T) {
+	containers := memory.NewContainerRepository(
+		registry.Container{ID: "container1", Name: "web", Port: 80},
+		registry.Container{ID: "container2", Name: "redis", Port: 6379},
+	)
+	services := memory.NewServiceRepository(&registry.Service{ID: "host1:container0:22", Service: "ssh", Port: 22})
+	reg := registry.NewRegistry(containers, services, "host1")
+	services.FailID("host1:container2:6379", errors.New("permission denied"))
+
+	report, err := reg.Synchronize(context.Background())
+
+	assert.IsType(t, &registry.SyncError{}, err)
+	assert.Equal(t, []registry.ServiceChange{{ServiceID: "host1:container1:80"}}, report.Registered)
+	assert.Equal(t, []registry.ServiceChange{{ServiceID: "host1:container0:22"}}, report.Deregistered)
+	assert.Len(t, report.Failed, 1)
+
+	services.ClearFaults()
+	report, err = reg.Synchronize(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []registry.ServiceChange{{ServiceID: "host1:container2:6379"}}, report.Registered)
+	assert.Equal(t, []*registry.Service{
+		{ID: "host1:container1:80", Service: "web", Port: 80},
+		{ID: "host1:container2:6379", Service: "redis", Port: 6379},
+	}, services.Services())
+}
+
+func TestSynchronizeChangesNothingWhenServicesCannotBeListed(t *testing.T) {
+	containers := memory.NewContainerRepository(registry.Container{ID: "container1", Name: "web", Port: 80})
+	services := memory.NewServiceRepository()
+	reg := registry.NewRegistry(containers, services, "host1")
+	expectedError := errors.New("consul unavailable")
+	services.FailNth(memory.GetAllCall, 1, expectedError)
+
+	_, err := reg.Synchronize(context.Background())
+	assert.Equal(t, expectedError, err)
+	assert.Equal(t, 0, services.Calls(memory.RegisterCall))
+
+	_, err = reg.Synchronize(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, services.Services(), 1)
+}
+
+func TestSynchronizeContainerFollowsContainerLifecycle(t *testing.T) {
+	containers := memory.NewContainerRepository()
+	services := memory.NewServiceRepository()
+	reg := registry.NewRegistry(containers, services, "host1")
+
+	containers.Add(registry.Container{ID: "container1", Name: "web", Port: 80}, registry.Container{ID: "container1", Name: "web", Port: 443})
+	report, err := reg.SynchronizeContainer(context.Background(), "container1")
+	assert.Nil(t, err)
+	assert.Equal(t, []registry.ServiceChange{{ServiceID: "host1:container1:80"}, {ServiceID: "host1:container1:443"}}, report.Registered)
+
+	containers.Remove("container1")
+	report, err = reg.SynchronizeContainer(context.Background(), "container1")
+	assert.Nil(t, err)
+	assert.Len(t, report.Deregistered, 2)
+	assert.Empty(t, services.Services())
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// backend is external service pencil depends on, probe tells whether it is reachable before ctx is done
+type backend struct {
+	name  string
+	probe func(ctx context.Context) error
+}
+
+var (
+	initialRetryDelay = 500 * time.Millisecond
+	maxRetryDelay     = 10 * time.Second
+	// probeTimeout limits single probe, so backend which accepts connections but never answers does not block
+	probeTimeout = 5 * time.Second
+)
+
+// waitUntilReachable calls probe with exponentially growing delays until it succeeds
+// or the next attempt would start after timeout, probes do not last past the timeout either
+func waitUntilReachable(name string, probe func(ctx context.Context) error, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := initialRetryDelay
+	for {
+		err := probeBefore(probe, deadline)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("%s is not reachable after %v: %v", name, timeout, err)
+		}
+		log.Printf("%s is not reachable, retrying in %v: %v\n", name, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// waitForBackends fails when any backend is not reachable within timeout, the timeout is shared by all backends,
+// so each one waits only for time left by the previous ones
+func waitForBackends(backends []backend, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, backend := range backends {
+		remaining := time.Until(deadline)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if err := waitUntilReachable(backend.name, backend.probe, remaining); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// probeBefore runs probe limited by probeTimeout and by deadline,
+// probe gets the whole probeTimeout when the deadline has already passed, so it is tried at least once
+func probeBefore(probe func(ctx context.Context) error, deadline time.Time) error {
+	timeout := time.Until(deadline)
+	if timeout <= 0 || timeout > probeTimeout {
+		timeout = probeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return probe(ctx)
+}
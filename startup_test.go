@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func init() {
+	initialRetryDelay = time.Millisecond
+	maxRetryDelay = 4 * time.Millisecond
+}
+
+func TestWaitUntilReachableRetriesFailingProbe(t *testing.T) {
+	attempts := 0
+	probe := func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	err := waitUntilReachable("docker", probe, time.Second)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestWaitUntilReachableGivesUpAfterTimeout(t *testing.T) {
+	attempts := 0
+	probe := func(ctx context.Context) error {
+		attempts++
+		return errors.New("connection refused")
+	}
+
+	err := waitUntilReachable("consul", probe, 20*time.Millisecond)
+
+	assert.EqualError(t, err, "consul is not reachable after 20ms: connection refused")
+	assert.True(t, attempts > 1)
+}
+
+func TestWaitUntilReachableWithoutTimeoutTriesOnce(t *testing.T) {
+	attempts := 0
+	probe := func(ctx context.Context) error {
+		attempts++
+		return errors.New("connection refused")
+	}
+
+	err := waitUntilReachable("docker", probe, 0)
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestWaitForBackendsSharesTimeout(t *testing.T) {
+	consulAttempts := 0
+	backends := []backend{
+		{"docker", func(ctx context.Context) error {
+			time.Sleep(30 * time.Millisecond)
+			return nil
+		}},
+		{"consul", func(ctx context.Context) error {
+			consulAttempts++
+			return errors.New("connection refused")
+		}},
+	}
+
+	err := waitForBackends(backends, 20*time.Millisecond)
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, consulAttempts)
+}
+
+func TestWaitUntilReachableCancelsHangingProbeAtTimeout(t *testing.T) {
+	probe := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	start := time.Now()
+	err := waitUntilReachable("consul", probe, 20*time.Millisecond)
+
+	assert.EqualError(t, err, "consul is not reachable after 20ms: context deadline exceeded")
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,64 @@
+package zookeeper
+
+import (
+	"github.com/alaa/pencil-go/metrics"
+	"github.com/go-zookeeper/zk"
+	"time"
+)
+
+const backend = "zookeeper"
+
+// instrumentedConn records latency and failures of ZooKeeper calls,
+// missing and already existing znodes are expected by the repository and are not counted as failures
+type instrumentedConn struct {
+	zkConn
+}
+
+func (c instrumentedConn) Children(path string) ([]string, *zk.Stat, error) {
+	start := time.Now()
+	children, stat, err := c.zkConn.Children(path)
+	metrics.ObserveCall(backend, "children", start, unexpected(err))
+	return children, stat, err
+}
+
+func (c instrumentedConn) Get(path string) ([]byte, *zk.Stat, error) {
+	start := time.Now()
+	data, stat, err := c.zkConn.Get(path)
+	metrics.ObserveCall(backend, "get", start, unexpected(err))
+	return data, stat, err
+}
+
+func (c instrumentedConn) Exists(path string) (bool, *zk.Stat, error) {
+	start := time.Now()
+	exists, stat, err := c.zkConn.Exists(path)
+	metrics.ObserveCall(backend, "exists", start, err)
+	return exists, stat, err
+}
+
+func (c instrumentedConn) Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	start := time.Now()
+	created, err := c.zkConn.Create(path, data, flags, acl)
+	metrics.ObserveCall(backend, "register", start, unexpected(err))
+	return created, err
+}
+
+func (c instrumentedConn) Set(path string, data []byte, version int32) (*zk.Stat, error) {
+	start := time.Now()
+	stat, err := c.zkConn.Set(path, data, version)
+	metrics.ObserveCall(backend, "register", start, err)
+	return stat, err
+}
+
+func (c instrumentedConn) Delete(path string, version int32) error {
+	start := time.Now()
+	err := c.zkConn.Delete(path, version)
+	metrics.ObserveCall(backend, "deregister", start, unexpected(err))
+	return err
+}
+
+func unexpected(err error) error {
+	if err == zk.ErrNoNode || err == zk.ErrNodeExists {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+package zookeeper
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/alaa/pencil-go/registry/memory"
+	"github.com/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"path"
+	"sort"
+	"testing"
+)
+
+const curatorInstance = `{"name":"billing","id":"0f8fad5b-d9cb-469f-a165-70867728950e","address":"10.0.0.9","port":8080}`
+
+func TestSynchronizeLeavesInstancesOfOtherHostsAndServicesIntact(t *testing.T) {
+	conn := newFakeZkConn()
+	conn.put("/services/billing/0f8fad5b-d9cb-469f-a165-70867728950e", []byte(curatorInstance), 7)
+	conn.putService(&registry.Service{ID: "host2:container9:80", Service: "web", Port: 80}, 7)
+	conn.putService(&registry.Service{ID: "host1:container0:80", Service: "web", Port: 80}, session)
+	containers := memory.NewContainerRepository(registry.Container{ID: "container1", Name: "web", Port: 80})
+	reg := registry.NewRegistry(containers, NewServiceRepository(conn, "/services", "host1"), "host1")
+
+	_, err := reg.Synchronize(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"/services/billing/0f8fad5b-d9cb-469f-a165-70867728950e",
+		"/services/web/host1:container1:80",
+		"/services/web/host2:container9:80",
+	}, conn.instances())
+
+	_, err = reg.DeregisterAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"/services/billing/0f8fad5b-d9cb-469f-a165-70867728950e",
+		"/services/web/host2:container9:80",
+	}, conn.instances())
+}
+
+func TestSynchronizeRecreatesInstancesOfPreviousSession(t *testing.T) {
+	conn := newFakeZkConn()
+	conn.putService(&registry.Service{ID: "host1:container1:80", Service: "web", Port: 80}, 7)
+	containers := memory.NewContainerRepository(registry.Container{ID: "container1", Name: "web", Port: 80})
+	reg := registry.NewRegistry(containers, NewServiceRepository(conn, "/services", "host1"), "host1")
+
+	report, err := reg.Synchronize(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []registry.ServiceChange{{ServiceID: "host1:container1:80"}}, report.Updated)
+	assert.Equal(t, session, conn.nodes["/services/web/host1:container1:80"].owner)
+}
+
+// fakeZkConn keeps znodes in memory, znodes with owner are ephemeral
+type fakeZkConn struct {
+	nodes map[string]*fakeZnode
+}
+
+type fakeZnode struct {
+	data    []byte
+	owner   int64
+	version int32
+}
+
+func newFakeZkConn() *fakeZkConn {
+	return &fakeZkConn{nodes: map[string]*fakeZnode{"/": {}}}
+}
+
+func (c *fakeZkConn) put(nodePath string, data []byte, owner int64) {
+	for parent := path.Dir(nodePath); c.nodes[parent] == nil; parent = path.Dir(parent) {
+		c.nodes[parent] = &fakeZnode{}
+	}
+	c.nodes[nodePath] = &fakeZnode{data: data, owner: owner}
+}
+
+func (c *fakeZkConn) putService(service *registry.Service, owner int64) {
+	data, _ := json.Marshal(newInstance(service))
+	c.put(path.Join("/services", service.Service, service.ID), data, owner)
+}
+
+// instances returns paths of ephemeral znodes
+func (c *fakeZkConn) instances() []string {
+	paths := []string{}
+	for nodePath, node := range c.nodes {
+		if node.owner != 0 {
+			paths = append(paths, nodePath)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (c *fakeZkConn) Children(parentPath string) ([]string, *zk.Stat, error) {
+	if c.nodes[parentPath] == nil {
+		return nil, nil, zk.ErrNoNode
+	}
+	children := []string{}
+	for nodePath := range c.nodes {
+		if nodePath != "/" && path.Dir(nodePath) == parentPath {
+			children = append(children, path.Base(nodePath))
+		}
+	}
+	sort.Strings(children)
+	return children, &zk.Stat{}, nil
+}
+
+func (c *fakeZkConn) Get(nodePath string) ([]byte, *zk.Stat, error) {
+	node := c.nodes[nodePath]
+	if node == nil {
+		return nil, nil, zk.ErrNoNode
+	}
+	return node.data, &zk.Stat{EphemeralOwner: node.owner, Version: node.version}, nil
+}
+
+func (c *fakeZkConn) Exists(nodePath string) (bool, *zk.Stat, error) {
+	node := c.nodes[nodePath]
+	if node == nil {
+		return false, &zk.Stat{}, nil
+	}
+	return true, &zk.Stat{EphemeralOwner: node.owner, Version: node.version}, nil
+}
+
+func (c *fakeZkConn) Create(nodePath string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	if c.nodes[nodePath] != nil {
+		return "", zk.ErrNodeExists
+	}
+	if c.nodes[path.Dir(nodePath)] == nil {
+		return "", zk.ErrNoNode
+	}
+	node := &fakeZnode{data: data}
+	if flags&zk.FlagEphemeral != 0 {
+		node.owner = session
+	}
+	c.nodes[nodePath] = node
+	return nodePath, nil
+}
+
+func (c *fakeZkConn) Set(nodePath string, data []byte, version int32) (*zk.Stat, error) {
+	node := c.nodes[nodePath]
+	if node == nil {
+		return nil, zk.ErrNoNode
+	}
+	if version != -1 && version != node.version {
+		return nil, zk.ErrBadVersion
+	}
+	node.data = data
+	node.version++
+	return &zk.Stat{EphemeralOwner: node.owner, Version: node.version}, nil
+}
+
+func (c *fakeZkConn) Delete(nodePath string, version int32) error {
+	node := c.nodes[nodePath]
+	if node == nil {
+		return zk.ErrNoNode
+	}
+	if version != -1 && version != node.version {
+		return zk.ErrBadVersion
+	}
+	delete(c.nodes, nodePath)
+	return nil
+}
+
+func (c *fakeZkConn) SessionID() int64 {
+	return session
+}
@@ -0,0 +1,263 @@
+// Package zookeeper keeps services in ZooKeeper in the layout of Curator ServiceDiscovery.
+//
+// Every service is an ephemeral znode "<base path>/<service name>/<service ID>" holding
+// Curator JSON instance, so JVM services using Curator discover containers registered by pencil
+// and registrations vanish when the ZooKeeper session of pencil ends.
+// Tags, meta and check of the service are kept in the instance payload.
+// Only instances which IDs start with "<hostname>:" are managed, instances of other hosts
+// and of JVM services are never reported nor removed. Instances owned by another session
+// are reported as well and synchronization creates them again in the current session.
+package zookeeper
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/go-zookeeper/zk"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// payloadClass makes Curator deserialize payload written by pencil as a map
+	payloadClass = "java.util.LinkedHashMap"
+	// dynamicServiceType is Curator service type of instances registered with ephemeral znodes
+	dynamicServiceType = "DYNAMIC"
+)
+
+type zkConn interface {
+	Children(path string) ([]string, *zk.Stat, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	Exists(path string) (bool, *zk.Stat, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Delete(path string, version int32) error
+	SessionID() int64
+}
+
+// instance is service instance in Curator ServiceDiscovery JSON format
+type instance struct {
+	Name                string      `json:"name"`
+	ID                  string      `json:"id"`
+	Address             string      `json:"address"`
+	Port                int         `json:"port"`
+	SSLPort             *int        `json:"sslPort"`
+	Payload             *payload    `json:"payload"`
+	RegistrationTimeUTC int64       `json:"registrationTimeUTC"`
+	ServiceType         string      `json:"serviceType"`
+	URISpec             interface{} `json:"uriSpec"`
+}
+
+// payload keeps service details which have no place in Curator instance
+type payload struct {
+	Class string                `json:"@class"`
+	Tags  []string              `json:"tags"`
+	Meta  map[string]string     `json:"meta,omitempty"`
+	Check registry.ServiceCheck `json:"check"`
+}
+
+// ServiceRepository is ZooKeeper-based implementation of registry.ServiceRepository,
+// it manages only instances which IDs start with its hostname, so instances of other hosts
+// and instances registered by Curator itself are left intact
+type ServiceRepository struct {
+	conn     zkConn
+	basePath string
+	idPrefix string
+	acl      []zk.ACL
+}
+
+// NewServiceRepository creates repository keeping services of hostname under basePath, e.g. "/services"
+func NewServiceRepository(conn zkConn, basePath string, hostname string) *ServiceRepository {
+	return &ServiceRepository{
+		conn:     instrumentedConn{conn},
+		basePath: path.Clean("/" + basePath),
+		idPrefix: hostname + ":",
+		acl:      zk.WorldACL(zk.PermAll),
+	}
+}
+
+// Register writes service instance to ephemeral znode of the current session,
+// znode left by another session, e.g. by previous pencil run, is replaced.
+// Instances of the service registered under another name are removed before the znode is created.
+func (r *ServiceRepository) Register(ctx context.Context, service *registry.Service) error {
+	data, err := json.Marshal(newInstance(service))
+	if err != nil {
+		return err
+	}
+	name := url.PathEscape(service.Service)
+	instancePath := r.nodePath(name, url.PathEscape(service.ID))
+	exists, stat, err := r.conn.Exists(instancePath)
+	if err != nil {
+		return err
+	}
+	if exists && stat.EphemeralOwner == r.conn.SessionID() {
+		_, err = r.conn.Set(instancePath, data, stat.Version)
+		return err
+	}
+	if exists {
+		if err := r.conn.Delete(instancePath, stat.Version); err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+	if err := r.deleteInstances(ctx, service.ID, name); err != nil {
+		return err
+	}
+	if err := r.createParents(path.Dir(instancePath)); err != nil {
+		return err
+	}
+	_, err = r.conn.Create(instancePath, data, zk.FlagEphemeral, r.acl)
+	return err
+}
+
+// Deregister removes znode of service instance, the service name is not known so all services are searched
+func (r *ServiceRepository) Deregister(ctx context.Context, serviceID string) error {
+	return r.deleteInstances(ctx, serviceID, "")
+}
+
+// deleteInstances removes znodes of service instance under all service names except keptName
+func (r *ServiceRepository) deleteInstances(ctx context.Context, serviceID string, keptName string) error {
+	names, _, err := r.conn.Children(r.basePath)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == keptName {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := r.conn.Delete(r.nodePath(name, url.PathEscape(serviceID)), -1)
+		if err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAll returns services of the host whichever session owns their znodes,
+// so services registered by another pencil process are reported too
+func (r *ServiceRepository) GetAll(ctx context.Context) ([]*registry.Service, error) {
+	services, _, err := r.list(ctx)
+	return services, err
+}
+
+// ForeignServices returns IDs of services which znodes are owned by another session,
+// e.g. by pencil before reload, Register replaces them with znodes of the current session
+func (r *ServiceRepository) ForeignServices(ctx context.Context) ([]string, error) {
+	_, foreignIDs, err := r.list(ctx)
+	return foreignIDs, err
+}
+
+// list returns services of the host and IDs of those owned by another session, invalid instances are skipped
+func (r *ServiceRepository) list(ctx context.Context) ([]*registry.Service, []string, error) {
+	services := []*registry.Service{}
+	foreignIDs := []string{}
+	names, _, err := r.conn.Children(r.basePath)
+	if err == zk.ErrNoNode {
+		return services, foreignIDs, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	sessionID := r.conn.SessionID()
+	for _, name := range names {
+		ids, _, err := r.conn.Children(r.nodePath(name))
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, id := range ids {
+			if !r.isOwned(id) {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+			data, stat, err := r.conn.Get(r.nodePath(name, id))
+			if err == zk.ErrNoNode {
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			instance := &instance{}
+			if err := json.Unmarshal(data, instance); err != nil || !strings.HasPrefix(instance.ID, r.idPrefix) {
+				continue
+			}
+			services = append(services, instance.service())
+			if sessionID == 0 || stat.EphemeralOwner != sessionID {
+				foreignIDs = append(foreignIDs, instance.ID)
+			}
+		}
+	}
+	return services, foreignIDs, nil
+}
+
+// isOwned tells whether znode name is escaped ID of service registered by pencil on this host
+func (r *ServiceRepository) isOwned(id string) bool {
+	serviceID, err := url.PathUnescape(id)
+	return err == nil && strings.HasPrefix(serviceID, r.idPrefix)
+}
+
+// nodePath joins znode names under the base path, names must be escaped as service names may contain slashes
+func (r *ServiceRepository) nodePath(names ...string) string {
+	return path.Join(append([]string{r.basePath}, names...)...)
+}
+
+// createParents creates missing persistent znodes of the path, they are shared by all instances of a service
+func (r *ServiceRepository) createParents(parentPath string) error {
+	exists, _, err := r.conn.Exists(parentPath)
+	if err != nil || exists {
+		return err
+	}
+	if parent := path.Dir(parentPath); parent != "/" {
+		if err := r.createParents(parent); err != nil {
+			return err
+		}
+	}
+	_, err = r.conn.Create(parentPath, nil, 0, r.acl)
+	if err == zk.ErrNodeExists {
+		return nil
+	}
+	return err
+}
+
+func newInstance(service *registry.Service) *instance {
+	return &instance{
+		Name:    service.Service,
+		ID:      service.ID,
+		Address: service.Address,
+		Port:    service.Port,
+		Payload: &payload{
+			Class: payloadClass,
+			Tags:  service.Tags,
+			Meta:  service.Meta,
+			Check: service.Check,
+		},
+		RegistrationTimeUTC: time.Now().UnixNano() / int64(time.Millisecond),
+		ServiceType:         dynamicServiceType,
+	}
+}
+
+func (i *instance) service() *registry.Service {
+	service := &registry.Service{
+		ID:      i.ID,
+		Service: i.Name,
+		Address: i.Address,
+		Port:    i.Port,
+	}
+	if i.Payload != nil {
+		service.Tags = i.Payload.Tags
+		service.Meta = i.Payload.Meta
+		service.Check = i.Payload.Check
+	}
+	return service
+}
@@ -0,0 +1,260 @@
+package zookeeper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/alaa/pencil-go/registry"
+	"github.com/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+const session = int64(42)
+
+var redis = &registry.Service{
+	ID:      "host1:container1:6379",
+	Service: "redis",
+	Tags:    []string{"cache"},
+	Meta:    map[string]string{"image": "redis:7"},
+	Address: "10.0.0.1",
+	Port:    6379,
+	Check:   registry.ServiceCheck{TCP: "true"},
+}
+
+func TestThatRegisterCreatesEphemeralInstanceAndParents(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "services", "host1")
+
+	conn.On("Exists", "/services/redis/host1:container1:6379").Return(false, &zk.Stat{}, nil)
+	conn.On("Children", "/services").Return([]string{}, &zk.Stat{}, zk.ErrNoNode)
+	conn.On("Exists", "/services/redis").Return(false, &zk.Stat{}, nil)
+	conn.On("Exists", "/services").Return(true, &zk.Stat{}, nil)
+	conn.On("Create", "/services/redis", int32(0)).Return("/services/redis", nil)
+	conn.On("Create", "/services/redis/host1:container1:6379", int32(zk.FlagEphemeral)).Return("/services/redis/host1:container1:6379", nil)
+
+	assert.Nil(t, repository.Register(context.Background(), redis))
+
+	conn.AssertExpectations(t)
+	instance := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(conn.written["/services/redis/host1:container1:6379"], &instance))
+	assert.Equal(t, "redis", instance["name"])
+	assert.Equal(t, "host1:container1:6379", instance["id"])
+	assert.Equal(t, "10.0.0.1", instance["address"])
+	assert.Equal(t, float64(6379), instance["port"])
+	assert.Equal(t, "DYNAMIC", instance["serviceType"])
+	assert.Nil(t, instance["sslPort"])
+	assert.Nil(t, instance["uriSpec"])
+	assert.NotZero(t, instance["registrationTimeUTC"])
+	assert.Equal(t, "java.util.LinkedHashMap", instance["payload"].(map[string]interface{})["@class"])
+}
+
+func TestThatRegisterUpdatesInstanceOfCurrentSession(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+
+	conn.On("Exists", "/services/redis/host1:container1:6379").Return(true, &zk.Stat{EphemeralOwner: session, Version: 3}, nil)
+	conn.On("Set", "/services/redis/host1:container1:6379", int32(3)).Return(&zk.Stat{}, nil)
+
+	assert.Nil(t, repository.Register(context.Background(), redis))
+
+	conn.AssertExpectations(t)
+	conn.AssertNotCalled(t, "Create", mock.Anything, mock.Anything)
+}
+
+func TestThatRegisterReplacesInstanceOfAnotherSession(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+
+	conn.On("Exists", "/services/redis/host1:container1:6379").Return(true, &zk.Stat{EphemeralOwner: 7, Version: 1}, nil)
+	conn.On("Delete", "/services/redis/host1:container1:6379", int32(1)).Return(nil)
+	conn.On("Children", "/services").Return([]string{"redis"}, &zk.Stat{}, nil)
+	conn.On("Exists", "/services/redis").Return(true, &zk.Stat{}, nil)
+	conn.On("Create", "/services/redis/host1:container1:6379", int32(zk.FlagEphemeral)).Return("", nil)
+
+	assert.Nil(t, repository.Register(context.Background(), redis))
+
+	conn.AssertExpectations(t)
+}
+
+func TestThatRegisterRemovesInstanceRegisteredUnderPreviousName(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+	renamed := &registry.Service{ID: redis.ID, Service: "cache", Port: 6379}
+
+	conn.On("Exists", "/services/cache/host1:container1:6379").Return(false, &zk.Stat{}, nil)
+	conn.On("Children", "/services").Return([]string{"cache", "redis"}, &zk.Stat{}, nil)
+	conn.On("Delete", "/services/redis/host1:container1:6379", int32(-1)).Return(nil)
+	conn.On("Exists", "/services/cache").Return(true, &zk.Stat{}, nil)
+	conn.On("Create", "/services/cache/host1:container1:6379", int32(zk.FlagEphemeral)).Return("", nil)
+
+	assert.Nil(t, repository.Register(context.Background(), renamed))
+
+	conn.AssertExpectations(t)
+	conn.AssertNotCalled(t, "Delete", "/services/cache/host1:container1:6379", mock.Anything)
+}
+
+func TestThatRegisterEscapesSlashesOfServiceName(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+	service := &registry.Service{ID: "host1:container1:80", Service: "team/web", Port: 80}
+
+	conn.On("Exists", "/services/team%2Fweb/host1:container1:80").Return(false, &zk.Stat{}, nil)
+	conn.On("Children", "/services").Return([]string{"team%2Fweb"}, &zk.Stat{}, nil)
+	conn.On("Exists", "/services/team%2Fweb").Return(true, &zk.Stat{}, nil)
+	conn.On("Create", "/services/team%2Fweb/host1:container1:80", int32(zk.FlagEphemeral)).Return("", nil)
+
+	assert.Nil(t, repository.Register(context.Background(), service))
+
+	conn.AssertExpectations(t)
+}
+
+func TestThatRegisterReturnsErrorWhenZookeeperFails(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+
+	conn.On("Exists", "/services/redis/host1:container1:6379").Return(false, &zk.Stat{}, zk.ErrNoServer)
+
+	err := repository.Register(context.Background(), redis)
+
+	assert.Equal(t, zk.ErrNoServer, err)
+	conn.AssertNotCalled(t, "Create", mock.Anything, mock.Anything)
+}
+
+func TestThatDeregisterDeletesInstanceOfAnyService(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+
+	conn.On("Children", "/services").Return([]string{"memcached", "redis"}, &zk.Stat{}, nil)
+	conn.On("Delete", "/services/memcached/host1:container1:6379", int32(-1)).Return(zk.ErrNoNode)
+	conn.On("Delete", "/services/redis/host1:container1:6379", int32(-1)).Return(nil)
+
+	err := repository.Deregister(context.Background(), "host1:container1:6379")
+
+	assert.Nil(t, err)
+	conn.AssertExpectations(t)
+}
+
+func TestThatDeregisterReturnsErrorWhenZookeeperFails(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+	expectedError := errors.New("zk: could not connect to a server")
+
+	conn.On("Children", "/services").Return([]string{"redis"}, &zk.Stat{}, nil)
+	conn.On("Delete", "/services/redis/host1:container1:6379", int32(-1)).Return(expectedError)
+
+	err := repository.Deregister(context.Background(), "host1:container1:6379")
+
+	assert.Equal(t, expectedError, err)
+}
+
+func TestThatGetAllReturnsServicesOfHostOwnedByAnySession(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+	data, _ := json.Marshal(newInstance(redis))
+
+	conn.On("Children", "/services").Return([]string{"redis", "web", "billing"}, &zk.Stat{}, nil)
+	conn.On("Children", "/services/redis").Return([]string{"host1:container1:6379", "host1:broken", "host2:container9:6379"}, &zk.Stat{}, nil)
+	conn.On("Children", "/services/web").Return([]string{}, &zk.Stat{}, zk.ErrNoNode)
+	conn.On("Children", "/services/billing").Return([]string{"0f8fad5b-d9cb-469f-a165-70867728950e"}, &zk.Stat{}, nil)
+	conn.On("Get", "/services/redis/host1:container1:6379").Return(data, &zk.Stat{EphemeralOwner: 7}, nil)
+	conn.On("Get", "/services/redis/host1:broken").Return([]byte("{"), &zk.Stat{EphemeralOwner: session}, nil)
+
+	services, err := repository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*registry.Service{redis}, services)
+	conn.AssertNotCalled(t, "Get", "/services/redis/host2:container9:6379")
+	conn.AssertNotCalled(t, "Get", "/services/billing/0f8fad5b-d9cb-469f-a165-70867728950e")
+}
+
+func TestThatForeignServicesListsInstancesOfAnotherSession(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+	web := &registry.Service{ID: "host1:container2:80", Service: "web", Port: 80}
+	redisData, _ := json.Marshal(newInstance(redis))
+	webData, _ := json.Marshal(newInstance(web))
+
+	conn.On("Children", "/services").Return([]string{"redis", "web"}, &zk.Stat{}, nil)
+	conn.On("Children", "/services/redis").Return([]string{"host1:container1:6379"}, &zk.Stat{}, nil)
+	conn.On("Children", "/services/web").Return([]string{"host1:container2:80"}, &zk.Stat{}, nil)
+	conn.On("Get", "/services/redis/host1:container1:6379").Return(redisData, &zk.Stat{EphemeralOwner: session}, nil)
+	conn.On("Get", "/services/web/host1:container2:80").Return(webData, &zk.Stat{EphemeralOwner: 7}, nil)
+
+	foreignIDs, err := repository.ForeignServices(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"host1:container2:80"}, foreignIDs)
+}
+
+func TestThatGetAllReturnsNoServicesWhenBasePathIsMissing(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+
+	conn.On("Children", "/services").Return([]string{}, &zk.Stat{}, zk.ErrNoNode)
+
+	services, err := repository.GetAll(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*registry.Service{}, services)
+}
+
+func TestThatGetAllReturnsErrorWhenZookeeperFails(t *testing.T) {
+	conn := new(MockZkConn)
+	repository := NewServiceRepository(conn, "/services", "host1")
+
+	conn.On("Children", "/services").Return([]string{}, &zk.Stat{}, zk.ErrNoServer)
+
+	_, err := repository.GetAll(context.Background())
+
+	assert.Equal(t, zk.ErrNoServer, err)
+}
+
+type MockZkConn struct {
+	mock.Mock
+	written map[string][]byte
+}
+
+func (c *MockZkConn) Children(path string) ([]string, *zk.Stat, error) {
+	args := c.Called(path)
+	return args.Get(0).([]string), args.Get(1).(*zk.Stat), args.Error(2)
+}
+
+func (c *MockZkConn) Get(path string) ([]byte, *zk.Stat, error) {
+	args := c.Called(path)
+	return args.Get(0).([]byte), args.Get(1).(*zk.Stat), args.Error(2)
+}
+
+func (c *MockZkConn) Exists(path string) (bool, *zk.Stat, error) {
+	args := c.Called(path)
+	return args.Bool(0), args.Get(1).(*zk.Stat), args.Error(2)
+}
+
+func (c *MockZkConn) Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	args := c.Called(path, flags)
+	c.write(path, data)
+	return args.String(0), args.Error(1)
+}
+
+func (c *MockZkConn) Set(path string, data []byte, version int32) (*zk.Stat, error) {
+	args := c.Called(path, version)
+	c.write(path, data)
+	return args.Get(0).(*zk.Stat), args.Error(1)
+}
+
+func (c *MockZkConn) Delete(path string, version int32) error {
+	args := c.Called(path, version)
+	return args.Error(0)
+}
+
+func (c *MockZkConn) SessionID() int64 {
+	return session
+}
+
+func (c *MockZkConn) write(path string, data []byte) {
+	if c.written == nil {
+		c.written = map[string][]byte{}
+	}
+	c.written[path] = data
+}